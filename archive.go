@@ -0,0 +1,327 @@
+package mosaic
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// archiveSep separates the archive from the path of a file in it, as in archive.zip!/path/img.jpg
+const archiveSep = "!/"
+
+func isArchive(format string) bool {
+	return format == "zip" || format == "tar" || format == "gzip"
+}
+
+// archiveFS is base with the files in its zip, tar and tar.gz archives readable by archive!/path names,
+// a tar.gz is unpacked to a temp file the first time it is used, so its files can be read in any order
+type archiveFS struct {
+	base     fs.FS
+	lock     sync.Mutex
+	archives map[string]*archive
+}
+
+type archive struct {
+	names   []string
+	open    func(name string) (fs.File, error)
+	closers []io.Closer
+	err     error
+}
+
+func new_archive_fs(base fs.FS) *archiveFS {
+	return &archiveFS{base: base, archives: make(map[string]*archive)}
+}
+
+func (a *archiveFS) Open(name string) (fs.File, error) {
+	ar, inner, err := a.split(name)
+	if err != nil {
+		return nil, err
+	}
+	var file fs.File
+	if ar == nil {
+		file, err = a.base.Open(name)
+	} else {
+		file, err = ar.open(inner)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return countFile{file}, nil
+}
+
+func (a *archiveFS) Stat(name string) (fs.FileInfo, error) {
+	if !strings.Contains(name, archiveSep) {
+		return fs.Stat(a.base, name)
+	}
+	file, err := a.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return file.Stat()
+}
+
+func (a *archiveFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(a.base, name)
+}
+
+// Files returns the names of the files in the archive name, format is what sniff_format found it to be
+func (a *archiveFS) Files(name string, format string) ([]string, error) {
+	ar, err := a.load(name, format)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(ar.names))
+	for _, inner := range ar.names {
+		files = append(files, name+archiveSep+inner)
+	}
+	return files, nil
+}
+
+// Close closes the archives and removes the unpacked tar.gz files
+func (a *archiveFS) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, ar := range a.archives {
+		for i := len(ar.closers) - 1; i >= 0; i-- {
+			ar.closers[i].Close()
+		}
+	}
+	a.archives = make(map[string]*archive)
+	return nil
+}
+
+// split returns the archive of name and the path in it, no archive when name is a file of base
+func (a *archiveFS) split(name string) (*archive, string, error) {
+	start := 0
+	for {
+		i := strings.Index(name[start:], archiveSep)
+		if i < 0 {
+			return nil, "", nil
+		}
+		i += start
+
+		// the archive is the first prefix that is a file
+		fi, err := fs.Stat(a.base, name[:i])
+		if err == nil && !fi.IsDir() {
+			format, err := sniff_format(a.base, name[:i])
+			if err != nil {
+				return nil, "", err
+			}
+			if !isArchive(format) {
+				return nil, "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+			}
+			ar, err := a.load(name[:i], format)
+			if err != nil {
+				return nil, "", err
+			}
+			return ar, name[i+len(archiveSep):], nil
+		}
+
+		start = i + len(archiveSep)
+	}
+}
+
+func (a *archiveFS) load(name string, format string) (*archive, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	ar, ok := a.archives[name]
+	if !ok {
+		ar = open_archive(a.base, name, format)
+		if ar.err != nil {
+			log.Printf("open_archive fail %s %s", name, ar.err)
+		}
+		a.archives[name] = ar
+	}
+	return ar, ar.err
+}
+
+func open_archive(base fs.FS, name string, format string) *archive {
+	ar := &archive{}
+
+	file, err := base.Open(name)
+	if err != nil {
+		ar.err = err
+		return ar
+	}
+	ar.closers = append(ar.closers, file)
+
+	fi, err := file.Stat()
+	if err != nil {
+		ar.err = err
+		return ar
+	}
+	size := fi.Size()
+
+	ra, ok := file.(io.ReaderAt)
+	if !ok && format != "gzip" {
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			ar.err = err
+			return ar
+		}
+		ra = bytes.NewReader(data)
+	}
+
+	switch format {
+	case "zip":
+		zr, err := zip.NewReader(ra, size)
+		if err != nil {
+			ar.err = err
+			return ar
+		}
+		files := make(map[string]*zip.File)
+		for _, f := range zr.File {
+			name := archive_name(f.Name)
+			if strings.HasSuffix(f.Name, "/") || files[name] != nil {
+				continue
+			}
+			files[name] = f
+			ar.names = append(ar.names, name)
+		}
+		ar.open = func(name string) (fs.File, error) {
+			f, ok := files[name]
+			if !ok {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			return &zipFile{rc, f}, nil
+		}
+	case "gzip":
+		gr, err := gzip.NewReader(file)
+		if err != nil {
+			ar.err = err
+			return ar
+		}
+		tmp, err := ioutil.TempFile("", "go-mosaic-*.tar")
+		if err != nil {
+			ar.err = err
+			return ar
+		}
+		ar.closers = append(ar.closers, removeFile{tmp})
+		log.Printf("open_archive unpack %s %s", name, tmp.Name())
+		size, err = io.Copy(tmp, gr)
+		if err != nil {
+			ar.err = err
+			return ar
+		}
+		ra = tmp
+		fallthrough
+	case "tar":
+		ar.err = index_tar(ar, io.NewSectionReader(ra, 0, size))
+	default:
+		ar.err = errors.New("unknown archive " + format)
+	}
+	return ar
+}
+
+// archive_name is the path of a file stored in an archive as name, without the ./ or / it may start with
+func archive_name(name string) string {
+	return path.Clean(strings.TrimLeft(name, "/"))
+}
+
+// zipFile is a file of a zip, opened by its entry, as zip.Reader.Open fails for entries named ./x or /x
+type zipFile struct {
+	io.ReadCloser
+	f *zip.File
+}
+
+func (f *zipFile) Stat() (fs.FileInfo, error) {
+	return f.f.FileInfo(), nil
+}
+
+// removeFile closes and removes a temp file
+type removeFile struct {
+	*os.File
+}
+
+func (f removeFile) Close() error {
+	f.File.Close()
+	return os.Remove(f.Name())
+}
+
+// tarFile is a file of a tar, read straight from where its data is in the tar
+type tarFile struct {
+	*io.SectionReader
+	hdr *tar.Header
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) {
+	return f.hdr.FileInfo(), nil
+}
+
+func (f *tarFile) Close() error {
+	return nil
+}
+
+// offsetReader keeps track of where in the tar the reader is, so the data of each file can be found again
+type offsetReader struct {
+	r   *io.SectionReader
+	pos int64
+}
+
+func (o *offsetReader) Read(p []byte) (int, error) {
+	n, err := o.r.Read(p)
+	o.pos += int64(n)
+	return n, err
+}
+
+func (o *offsetReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := o.r.Seek(offset, whence)
+	if err == nil {
+		o.pos = pos
+	}
+	return pos, err
+}
+
+func index_tar(ar *archive, sr *io.SectionReader) error {
+	type entry struct {
+		hdr    *tar.Header
+		offset int64
+	}
+	entries := map[string]entry{}
+
+	or := &offsetReader{r: sr}
+	tr := tar.NewReader(or)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		name := archive_name(hdr.Name)
+		if _, ok := entries[name]; ok {
+			continue
+		}
+		entries[name] = entry{hdr, or.pos}
+		ar.names = append(ar.names, name)
+	}
+
+	ar.open = func(name string) (fs.File, error) {
+		e, ok := entries[name]
+		if !ok {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		return &tarFile{io.NewSectionReader(sr, e.offset, e.hdr.Size), e.hdr}, nil
+	}
+	return nil
+}
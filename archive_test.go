@@ -0,0 +1,177 @@
+package mosaic
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/chyroc/go-ptr"
+)
+
+// write_test_tar writes files to a tar at filename, gzipped when zipped is set
+func write_test_tar(t *testing.T, filename string, files map[string][]byte, zipped bool) {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(files[name])
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := b.Bytes()
+	if zipped {
+		var z bytes.Buffer
+		zw := gzip.NewWriter(&z)
+		zw.Write(data)
+		zw.Close()
+		data = z.Bytes()
+	}
+	if err := os.WriteFile(filename, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func write_test_zip(t *testing.T, filename string, files map[string][]byte) {
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIndexArchives(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib")
+	if err := os.MkdirAll(filepath.Join(lib, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	// the temp files of tar.gz archives go to TMPDIR
+	tmpdir := filepath.Join(dir, "tmp")
+	os.Mkdir(tmpdir, 0o755)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmpdir)
+
+	pics := map[string][]byte{}
+	for i := 0; i < 4; i++ {
+		pics[fmt.Sprintf("dir/%d.png", i)] = test_pic(t, i)
+	}
+	pics["notes.txt"] = []byte("no pic")
+
+	var nested bytes.Buffer
+	zw := zip.NewWriter(&nested)
+	w, _ := zw.Create("inner.png")
+	w.Write(test_pic(t, 7))
+	zw.Close()
+
+	write_test_zip(t, filepath.Join(lib, "a.zip"), map[string][]byte{"x/0.png": pics["dir/0.png"], "1.png": pics["dir/1.png"], "nested.zip": nested.Bytes()})
+	write_test_tar(t, filepath.Join(lib, "sub", "b.tar.gz"), pics, true)
+	write_test_tar(t, filepath.Join(lib, "c.tar"), map[string][]byte{"./2.png": pics["dir/2.png"], "/3.png": pics["dir/3.png"]}, false)
+	// entries named ./x or /x are read by their zip entry
+	write_test_zip(t, filepath.Join(lib, "d.zip"), map[string][]byte{"./dot/0.png": pics["dir/0.png"], "/lead.png": pics["dir/1.png"], "dir/": nil})
+	if err := os.WriteFile(filepath.Join(lib, "bad.zip"), []byte("PK\x03\x04broken"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(lib, "plain.png"), test_pic(t, 5), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	abs := func(name string) string { return filepath.Join(lib, name) }
+	want := map[string][]byte{
+		abs("a.zip") + "!/x/0.png":          pics["dir/0.png"],
+		abs("a.zip") + "!/1.png":            pics["dir/1.png"],
+		abs("sub/b.tar.gz") + "!/dir/0.png": pics["dir/0.png"],
+		abs("sub/b.tar.gz") + "!/dir/1.png": pics["dir/1.png"],
+		abs("sub/b.tar.gz") + "!/dir/2.png": pics["dir/2.png"],
+		abs("sub/b.tar.gz") + "!/dir/3.png": pics["dir/3.png"],
+		abs("c.tar") + "!/2.png":            pics["dir/2.png"],
+		abs("c.tar") + "!/3.png":            pics["dir/3.png"],
+		abs("d.zip") + "!/dot/0.png":        pics["dir/0.png"],
+		abs("d.zip") + "!/lead.png":         pics["dir/1.png"],
+		abs("plain.png"):                    test_pic(t, 5),
+	}
+	var wantnames []string
+	for name := range want {
+		wantnames = append(wantnames, name)
+	}
+	sort.Strings(wantnames)
+
+	req := &Request{Lib: lib, Database: ptr.String(filepath.Join(dir, "database.bin")), PixelSize: ptr.Int(8), Worker: ptr.Int(4)}
+	for run := 0; run < 2; run++ {
+		if err := Index(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		if got := lib_filenames(t, req); fmt.Sprint(got) != fmt.Sprint(wantnames) {
+			t.Fatalf("run %d indexed %v want %v", run, got, wantnames)
+		}
+		if entries, _ := os.ReadDir(tmpdir); len(entries) != 0 {
+			t.Fatalf("run %d left the unpacked tar.gz behind", run)
+		}
+	}
+
+	libfs := new_archive_fs(hostFS{})
+	defer libfs.Close()
+	for name, data := range want {
+		file, err := libfs.Open(name)
+		if err != nil {
+			t.Fatalf("Open %s: %s", name, err)
+		}
+		got, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("read %s: %d bytes %v", name, len(got), err)
+		}
+		if fi, err := libfs.Stat(name); err != nil || fi.Size() != int64(len(data)) {
+			t.Fatalf("Stat %s: %v %v", name, fi, err)
+		}
+	}
+	for _, name := range []string{abs("a.zip") + "!/missing.png", abs("plain.png") + "!/x.png", abs("bad.zip") + "!/x.png"} {
+		if file, err := libfs.Open(name); err == nil {
+			file.Close()
+			t.Fatalf("Open %s did not fail", name)
+		}
+	}
+	if entries, _ := os.ReadDir(tmpdir); len(entries) != 1 {
+		t.Fatalf("the tar.gz is unpacked to %d files", len(entries))
+	}
+	libfs.Close()
+	if entries, _ := os.ReadDir(tmpdir); len(entries) != 0 {
+		t.Fatalf("Close left the unpacked tar.gz behind")
+	}
+
+	// a removed archive drops its pics
+	os.Remove(abs("sub/b.tar.gz"))
+	if err := Index(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if got := lib_filenames(t, req); len(got) != 7 {
+		t.Fatalf("after removing the tar.gz indexed %v", got)
+	}
+}
@@ -0,0 +1,151 @@
+package mosaic
+
+import (
+	"container/list"
+	"image"
+	"sync"
+)
+
+// TileCache is a size bounded LRU of scaled tile images keyed by library file
+type TileCache struct {
+	lock    sync.Mutex
+	max     int64
+	size    int64
+	ll      *list.List
+	items   map[string]*list.Element
+	loading map[string]*tileLoad
+	stat    TileCacheStat
+}
+
+// TileCacheStat says how well the tile cache of a render works
+type TileCacheStat struct {
+	Hit  int64 // tiles found in the cache
+	Miss int64 // tiles read from the database
+	Num  int   // tiles in the cache
+	Size int64 // bytes of the tiles in the cache
+}
+
+type tileLoad struct {
+	wg  sync.WaitGroup
+	img image.Image
+	err error
+}
+
+type tileCacheEntry struct {
+	key  string
+	img  image.Image
+	size int64
+}
+
+func NewTileCache(max int64) *TileCache {
+	return &TileCache{max: max, ll: list.New(), items: make(map[string]*list.Element), loading: make(map[string]*tileLoad)}
+}
+
+// GetOrLoad returns the cached tile for key, or loads it once no matter how many workers miss on it together
+func (tc *TileCache) GetOrLoad(key string, load func() (image.Image, error)) (image.Image, error) {
+	tc.lock.Lock()
+	if e, ok := tc.items[key]; ok {
+		tc.stat.Hit++
+		metricTileHits.Add(1)
+		tc.ll.MoveToFront(e)
+		tc.lock.Unlock()
+		return e.Value.(*tileCacheEntry).img, nil
+	}
+	if l, ok := tc.loading[key]; ok {
+		tc.stat.Hit++
+		metricTileHits.Add(1)
+		tc.lock.Unlock()
+		l.wg.Wait()
+		return l.img, l.err
+	}
+	tc.stat.Miss++
+	metricTileMisses.Add(1)
+	l := &tileLoad{}
+	l.wg.Add(1)
+	tc.loading[key] = l
+	tc.lock.Unlock()
+
+	l.img, l.err = load()
+	if l.err == nil {
+		tc.Add(key, l.img)
+	}
+
+	tc.lock.Lock()
+	delete(tc.loading, key)
+	tc.lock.Unlock()
+	l.wg.Done()
+
+	return l.img, l.err
+}
+
+func (tc *TileCache) Add(key string, img image.Image) {
+	size := int64(img.Bounds().Dx()) * int64(img.Bounds().Dy()) * 4
+	if size > tc.max {
+		return
+	}
+
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	if e, ok := tc.items[key]; ok {
+		old := e.Value.(*tileCacheEntry)
+		tc.size += size - old.size
+		old.img, old.size = img, size
+		tc.ll.MoveToFront(e)
+	} else {
+		tc.items[key] = tc.ll.PushFront(&tileCacheEntry{key, img, size})
+		tc.size += size
+	}
+
+	for tc.size > tc.max {
+		e := tc.ll.Back()
+		old := e.Value.(*tileCacheEntry)
+		tc.ll.Remove(e)
+		delete(tc.items, old.key)
+		tc.size -= old.size
+	}
+}
+
+func (tc *TileCache) GetStat() TileCacheStat {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	stat := tc.stat
+	stat.Num = tc.ll.Len()
+	stat.Size = tc.size
+	return stat
+}
+
+// MatchCache memoizes the closest library files per source color, the database scan for a color runs once even if many workers ask for it at the same time
+type MatchCache struct {
+	lock  sync.Mutex
+	items map[string]*matchCall
+}
+
+type matchCall struct {
+	wg  sync.WaitGroup
+	fis []FileInfo
+	err error
+}
+
+func NewMatchCache() *MatchCache {
+	return &MatchCache{items: make(map[string]*matchCall)}
+}
+
+// Do returns the files cached for key, calling fill to compute them if no other caller has, shared reports whether fill was run by someone else
+func (mc *MatchCache) Do(key string, fill func() ([]FileInfo, error)) (fis []FileInfo, shared bool, err error) {
+	mc.lock.Lock()
+	if c, ok := mc.items[key]; ok {
+		mc.lock.Unlock()
+		c.wg.Wait()
+		return c.fis, true, c.err
+	}
+	c := &matchCall{}
+	c.wg.Add(1)
+	mc.items[key] = c
+	mc.lock.Unlock()
+
+	defer c.wg.Done()
+	c.fis, c.err = fill()
+	return c.fis, false, c.err
+}
@@ -0,0 +1,302 @@
+package mosaic
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sync"
+)
+
+// Cell is one tile of the mosaic, X, Y are its column and row in the layout, for Square they are the src pixel
+// it starts at and it covers Size*Size src pixels, Rect is where the tile goes in the mosaic
+type Cell struct {
+	X    int
+	Y    int
+	Size int
+	Rect image.Rectangle
+	C    color.RGBA
+	Grid [4]color.RGBA // avg src color of the top left, top right, bottom left, bottom right of the cell
+
+	Match *Match // tile of the cell when it is matched before rendering
+}
+
+func isLayout(layout string) bool {
+	return layout == "Square" || layout == "Brick" || layout == "Hex" || layout == "Circle"
+}
+
+// gen_cells lays the cells of the layout over the mosaic of src, one src pixel is one tilew*tileh tile of the mosaic,
+// detail is src at a higher resolution the grid of each cell is taken from
+func gen_cells(src image.Image, detail image.Image, masks *MaskCache, quadtree int, threshold float64) []Cell {
+	layout := masks.layout
+	tilew := masks.tilew
+	tileh := masks.tileh
+
+	bounds := src.Bounds()
+	mosaic := image.Rect(0, 0, bounds.Dx()*tilew, bounds.Dy()*tileh)
+	size := mosaic.Max
+
+	cells := make([]Cell, 0, bounds.Dx()*bounds.Dy())
+	switch layout {
+	case "Brick":
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := -(y % 2); x < bounds.Dx(); x++ {
+				cell := Cell{X: x, Y: y, Size: 1}
+				cell.Rect = cell_rect(layout, cell, tilew, tileh)
+				cell.C = shape_color(src, size, cell.Rect, cell.Rect, nil)
+				cells = append(cells, cell)
+			}
+		}
+	case "Hex":
+		for y := -1; float64(y)*0.75*float64(tileh) < float64(mosaic.Max.Y); y++ {
+			for x := -1; float64(x)*float64(tilew) < float64(mosaic.Max.X); x++ {
+				cell := Cell{X: x, Y: y, Size: 1}
+				cell.Rect = cell_rect(layout, cell, tilew, tileh)
+				if !cell.Rect.Overlaps(mosaic) {
+					continue
+				}
+				cell.C = shape_color(src, size, cell.Rect, cell.Rect, masks.Get(cell))
+				cells = append(cells, cell)
+			}
+		}
+	case "Circle":
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				cell := Cell{X: x, Y: y, Size: 1}
+				cell.Rect = cell_rect(layout, cell, tilew, tileh)
+				cell.C = shape_color(src, size, cell.Rect, cell.Rect, masks.Get(cell))
+				cells = append(cells, cell)
+			}
+		}
+	default:
+		block := maxInt(quadtree, 1)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y += block {
+			for x := bounds.Min.X; x < bounds.Max.X; x += block {
+				cells = quad_cells(src, image.Rect(x, y, x+block, y+block), tilew, tileh, threshold, cells)
+			}
+		}
+	}
+
+	for i := range cells {
+		cell := &cells[i]
+		mask := masks.Get(*cell)
+		midx := cell.Rect.Min.X + cell.Rect.Dx()/2
+		midy := cell.Rect.Min.Y + cell.Rect.Dy()/2
+		for j, area := range []image.Rectangle{
+			image.Rect(cell.Rect.Min.X, cell.Rect.Min.Y, midx, midy),
+			image.Rect(midx, cell.Rect.Min.Y, cell.Rect.Max.X, midy),
+			image.Rect(cell.Rect.Min.X, midy, midx, cell.Rect.Max.Y),
+			image.Rect(midx, midy, cell.Rect.Max.X, cell.Rect.Max.Y),
+		} {
+			cell.Grid[j] = shape_color(detail, size, cell.Rect, area, mask)
+		}
+	}
+	return cells
+}
+
+func quad_cells(src image.Image, rect image.Rectangle, tilew int, tileh int, threshold float64, cells []Cell) []Cell {
+	bounds := src.Bounds()
+
+	if rect.In(bounds) {
+		c, deviation := region_color(src, rect)
+		if rect.Dx() == 1 || deviation <= threshold {
+			x := rect.Min.X - bounds.Min.X
+			y := rect.Min.Y - bounds.Min.Y
+			size := rect.Dx()
+			return append(cells, Cell{X: x, Y: y, Size: size, Rect: image.Rect(x*tilew, y*tileh, (x+size)*tilew, (y+size)*tileh), C: c})
+		}
+	}
+
+	half := rect.Dx() / 2
+	for _, sub := range []image.Rectangle{
+		image.Rect(rect.Min.X, rect.Min.Y, rect.Min.X+half, rect.Min.Y+half),
+		image.Rect(rect.Min.X+half, rect.Min.Y, rect.Max.X, rect.Min.Y+half),
+		image.Rect(rect.Min.X, rect.Min.Y+half, rect.Min.X+half, rect.Max.Y),
+		image.Rect(rect.Min.X+half, rect.Min.Y+half, rect.Max.X, rect.Max.Y),
+	} {
+		if sub.Overlaps(bounds) {
+			cells = quad_cells(src, sub, tilew, tileh, threshold, cells)
+		}
+	}
+	return cells
+}
+
+// region_color returns the avg color of rect in src and the root mean square distance of its pixels to it
+func region_color(src image.Image, rect image.Rectangle) (color.RGBA, float64) {
+	var sumR, sumG, sumB, sumSq, count float64
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			r, g, b, _ := src.At(x, y).RGBA()
+			fr, fg, fb := float64(r>>8), float64(g>>8), float64(b>>8)
+			sumR += fr
+			sumG += fg
+			sumB += fb
+			sumSq += fr*fr + fg*fg + fb*fb
+			count++
+		}
+	}
+
+	avgR, avgG, avgB := sumR/count, sumG/count, sumB/count
+	variance := sumSq/count - (avgR*avgR + avgG*avgG + avgB*avgB)
+	return color.RGBA{uint8(avgR), uint8(avgG), uint8(avgB), 0}, math.Sqrt(math.Max(variance, 0))
+}
+
+// shape_color averages src, stretched over a mosaic of size, over the part of area that the mask of the cell at rect lets through
+func shape_color(src image.Image, size image.Point, rect image.Rectangle, area image.Rectangle, mask *image.Alpha) color.RGBA {
+	const samples = 8
+
+	bounds := src.Bounds()
+	var sumR, sumG, sumB, weight float64
+	for j := 0; j < samples; j++ {
+		for i := 0; i < samples; i++ {
+			px := area.Min.X + (2*i+1)*area.Dx()/(2*samples)
+			py := area.Min.Y + (2*j+1)*area.Dy()/(2*samples)
+			if px < 0 || py < 0 || px >= size.X || py >= size.Y {
+				continue
+			}
+
+			w := 1.0
+			if mask != nil {
+				w = float64(mask.AlphaAt(px-rect.Min.X, py-rect.Min.Y).A) / 255
+				if w == 0 {
+					continue
+				}
+			}
+
+			r, g, b, _ := src.At(bounds.Min.X+px*bounds.Dx()/size.X, bounds.Min.Y+py*bounds.Dy()/size.Y).RGBA()
+			sumR += float64(r>>8) * w
+			sumG += float64(g>>8) * w
+			sumB += float64(b>>8) * w
+			weight += w
+		}
+	}
+
+	if weight == 0 {
+		return color.RGBA{}
+	}
+	return color.RGBA{uint8(sumR / weight), uint8(sumG / weight), uint8(sumB / weight), 0}
+}
+
+// hex_center is the center of the pointy top hex at column x, row y, rows are 3/4 tile apart and odd ones shift half a tile
+func hex_center(x int, y int, tilew int, tileh int) (float64, float64) {
+	return (float64(x) + 0.5 + 0.5*float64(y&1)) * float64(tilew), (float64(y)*0.75 + 0.5) * float64(tileh)
+}
+
+// hex_owner returns the hex whose center is nearest to the mosaic point px, py, measured so that the nearest
+// center regions are exactly the hexes, so every mosaic pixel belongs to one hex
+func hex_owner(px float64, py float64, tilew int, tileh int) (int, int) {
+	row := int(math.Floor((py/float64(tileh) - 0.5) / 0.75))
+	bestx, besty := 0, 0
+	best := math.MaxFloat64
+	for y := row - 1; y <= row+2; y++ {
+		col := int(math.Floor(px/float64(tilew) - 0.5*float64(y&1)))
+		for x := col - 1; x <= col+1; x++ {
+			cx, cy := hex_center(x, y, tilew, tileh)
+			dx := (px - cx) / float64(tilew)
+			dy := (py - cy) / float64(tileh)
+			d := dx*dx + dy*dy*4/3
+			if d < best-1e-12 {
+				best, bestx, besty = d, x, y
+			}
+		}
+	}
+	return bestx, besty
+}
+
+// cell_rect is where the tile of cell goes by its X, Y and Size, so a cell can be laid again at another tile size
+func cell_rect(layout string, cell Cell, tilew int, tileh int) image.Rectangle {
+	switch layout {
+	case "Hex":
+		cx, cy := hex_center(cell.X, cell.Y, tilew, tileh)
+		minx := int(math.Floor(cx - float64(tilew)/2 + 0.5))
+		miny := int(math.Floor(cy - float64(tileh)/2 + 0.5))
+		return image.Rect(minx, miny, minx+tilew, miny+tileh)
+	case "Brick":
+		offset := (cell.Y % 2) * tilew / 2
+		return image.Rect(cell.X*tilew+offset, cell.Y*tileh, (cell.X+1)*tilew+offset, (cell.Y+1)*tileh)
+	}
+	return image.Rect(cell.X*tilew, cell.Y*tileh, (cell.X+cell.Size)*tilew, (cell.Y+cell.Size)*tileh)
+}
+
+// cell_mask returns which part of cell.Rect the tile covers, nil means all of it
+func cell_mask(layout string, cell Cell, tilew int, tileh int) *image.Alpha {
+	switch layout {
+	case "Hex":
+		mask := image.NewAlpha(image.Rect(0, 0, cell.Rect.Dx(), cell.Rect.Dy()))
+		for y := 0; y < cell.Rect.Dy(); y++ {
+			for x := 0; x < cell.Rect.Dx(); x++ {
+				ox, oy := hex_owner(float64(cell.Rect.Min.X+x)+0.5, float64(cell.Rect.Min.Y+y)+0.5, tilew, tileh)
+				if ox == cell.X && oy == cell.Y {
+					mask.Pix[mask.PixOffset(x, y)] = 255
+				}
+			}
+		}
+		return mask
+	case "Circle":
+		const samples = 4
+		w := cell.Rect.Dx()
+		h := cell.Rect.Dy()
+		mask := image.NewAlpha(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				in := 0
+				for j := 0; j < samples; j++ {
+					for i := 0; i < samples; i++ {
+						u := (float64(x)+(float64(i)+0.5)/samples)/float64(w)*2 - 1
+						v := (float64(y)+(float64(j)+0.5)/samples)/float64(h)*2 - 1
+						if u*u+v*v <= 1 {
+							in++
+						}
+					}
+				}
+				mask.Pix[mask.PixOffset(x, y)] = uint8(in * 255 / (samples * samples))
+			}
+		}
+		return mask
+	}
+	return nil
+}
+
+// MaskCache hands out the cell masks of a layout, Circle cells share one mask and Hex cells one per row mod 4,
+// as hex rows repeat their sub pixel position every 4 rows
+type MaskCache struct {
+	layout string
+	tilew  int
+	tileh  int
+	lock   sync.Mutex
+	masks  map[int]*image.Alpha
+}
+
+func NewMaskCache(layout string, tilew int, tileh int) *MaskCache {
+	return &MaskCache{layout: layout, tilew: tilew, tileh: tileh, masks: make(map[int]*image.Alpha)}
+}
+
+func (mc *MaskCache) Get(cell Cell) *image.Alpha {
+	if mc.layout != "Hex" && mc.layout != "Circle" {
+		return nil
+	}
+
+	key := 0
+	if mc.layout == "Hex" {
+		key = cell.Y & 3
+	}
+
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	mask, ok := mc.masks[key]
+	if !ok {
+		mask = cell_mask(mc.layout, cell, mc.tilew, mc.tileh)
+		mc.masks[key] = mask
+	}
+	return mask
+}
+
+// parse_color parses a #rrggbb color
+func parse_color(s string) (color.RGBA, error) {
+	var r, g, b uint8
+	_, err := fmt.Sscanf(s, "#%02x%02x%02x", &r, &g, &b)
+	if err != nil {
+		return color.RGBA{}, err
+	}
+	return color.RGBA{r, g, b, 255}, nil
+}
@@ -0,0 +1,80 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+func TestQuadCells(t *testing.T) {
+	// the left 16*16 is flat, the right one is noise but for a top left 8*8 of two close grays
+	src := image.NewRGBA(image.Rect(0, 0, 32, 16))
+	rnd := rand.New(rand.NewSource(1))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 32; x++ {
+			switch {
+			case x < 16:
+				src.Set(x, y, color.RGBA{90, 120, 150, 255})
+			case x < 24 && y < 8:
+				v := uint8(100 + (x+y)%2*4)
+				src.Set(x, y, color.RGBA{v, v, v, 255})
+			default:
+				src.Set(x, y, color.RGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), 255})
+			}
+		}
+	}
+	flat := image.NewRGBA(image.Rect(0, 0, 24, 16))
+	for p := range flat.Pix {
+		flat.Pix[p] = 200
+	}
+
+	for _, tt := range []struct {
+		name      string
+		src       image.Image
+		quadtree  int
+		threshold float64
+		sizes     map[int]int // number of cells of each size
+	}{
+		{"split", src, 16, 5, map[int]int{16: 1, 8: 1, 1: 3 * 64}},
+		// the two grays deviate by 2, so they split down to single pixels under a lower limit
+		{"low limit", src, 16, 1, map[int]int{16: 1, 1: 256}},
+		{"high limit", src, 16, 1000, map[int]int{16: 2}},
+		{"smaller max", src, 4, 5, map[int]int{4: 16 + 4, 1: 3 * 64}},
+		{"disabled", src, 1, 1000, map[int]int{1: 512}},
+		// blocks past the src edge split until they fit
+		{"edge", flat, 16, 5, map[int]int{16: 1, 8: 2}},
+	} {
+		masks := NewMaskCache("Square", 6, 4)
+		cells := gen_cells(tt.src, tt.src, masks, tt.quadtree, tt.threshold)
+
+		sizes := map[int]int{}
+		area := 0
+		covered := map[image.Point]bool{}
+		for _, cell := range cells {
+			sizes[cell.Size]++
+			area += cell.Size * cell.Size
+			if cell.Rect != image.Rect(cell.X*6, cell.Y*4, (cell.X+cell.Size)*6, (cell.Y+cell.Size)*4) {
+				t.Fatalf("%s: cell %d,%d size %d at %v", tt.name, cell.X, cell.Y, cell.Size, cell.Rect)
+			}
+			for y := cell.Y; y < cell.Y+cell.Size; y++ {
+				for x := cell.X; x < cell.X+cell.Size; x++ {
+					covered[image.Pt(x, y)] = true
+				}
+			}
+		}
+		if len(sizes) != len(tt.sizes) {
+			t.Fatalf("%s: sizes %v want %v", tt.name, sizes, tt.sizes)
+		}
+		for size, n := range tt.sizes {
+			if sizes[size] != n {
+				t.Fatalf("%s: sizes %v want %v", tt.name, sizes, tt.sizes)
+			}
+		}
+		// the cells cover the src once
+		bounds := tt.src.Bounds()
+		if area != bounds.Dx()*bounds.Dy() || len(covered) != area {
+			t.Fatalf("%s: cells cover %d of %d pixels, %d once", tt.name, area, bounds.Dx()*bounds.Dy(), len(covered))
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	mosaic "github.com/chyroc/go-mosaic"
+	"github.com/chyroc/go-ptr"
+)
+
+// libFlag collects repeated -lib name=path flags
+type libFlag map[string]string
+
+func (l libFlag) String() string {
+	libs := make([]string, 0, len(l))
+	for name, path := range l {
+		libs = append(libs, name+"="+path)
+	}
+	return strings.Join(libs, ",")
+}
+
+func (l libFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("lib should be name=path")
+	}
+	l[s[:i]] = s[i+1:]
+	return nil
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serve(os.Args[2:])
+		return
+	}
+
+	src := flag.String("src", "", "src image path")
+	target := flag.String("target", "", "target image path")
+	lib := flag.String("lib", "", "image lib path")
+	worker := flag.Int("worker", 12, "worker thread num")
+	database := flag.String("database", "./database.bin", "cache datbase")
+	scalealg := flag.String("scalealg", "CatmullRom", "pic scale function NearestNeighbor/ApproxBiLinear/BiLinear/CatmullRom/Area")
+	checkhash := flag.Bool("checkhash", true, "check database pic hash")
+	maxsize := flag.Int("maxsize", 4, "pic max size in GB")
+	libname := flag.String("libname", "default", "image lib name in database")
+	pixelsize := flag.Int("pixelsize", 64, "pic scale size per one pixel")
+	srcsize := flag.Int("srcsize", 128, "src image auto scale pixel size")
+	flag.Parse()
+
+	if *src == "" || *target == "" || *lib == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := mosaic.Mosaic(&mosaic.Request{
+		Src:       *src,
+		Target:    *target,
+		Lib:       *lib,
+		Worker:    worker,
+		Database:  database,
+		Scalealg:  scalealg,
+		CheckHash: checkhash,
+		MaxSize:   maxsize,
+		LibName:   libname,
+		PixelSize: pixelsize,
+		SrcSize:   srcsize,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serve runs a mosaic.Server, go-mosaic serve -lib photos=./photos -lib events=./events
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	libs := libFlag{}
+	fs.Var(libs, "lib", "image lib jobs can use as name=path, can be repeated")
+	addr := fs.String("addr", ":8080", "http listen address")
+	dir := fs.String("dir", "./jobs", "dir of uploaded srcs and targets")
+	queue := fs.Int("queue", 16, "max jobs waiting to run")
+	worker := fs.Int("worker", 12, "worker thread num of a job")
+	database := fs.String("database", "./database.bin", "cache datbase")
+	maxsize := fs.Int("maxsize", 4, "pic max size in GB")
+	keep := fs.Duration("keep", 24*time.Hour, "how long finished jobs and uploaded srcs are kept, 0 keeps them until deleted")
+	fs.Parse(args)
+
+	if len(libs) <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	req := &mosaic.Request{Worker: worker, Database: database, MaxSize: maxsize, CheckHash: ptr.Bool(true)}
+	server, err := mosaic.NewServer(context.Background(), req, libs, *dir, *queue, *keep)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("serve %s libs %s", *addr, libs)
+	log.Fatal(http.ListenAndServe(*addr, server))
+}
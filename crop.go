@@ -0,0 +1,246 @@
+package mosaic
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"log"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+// crop analysis works on a copy of the pic no longer than this
+const cropAnalysisSize = 64
+
+func isCrop(crop string) bool {
+	return crop == "Center" || crop == "Entropy" || crop == "Edge" || crop == "Skin"
+}
+
+// crop_box returns the biggest part of src with the tile aspect, Center takes the middle one, the others slide
+// the window along the long side to where the pic is the most busy (Entropy/Edge) or shows the most skin (Skin)
+func crop_box(src image.Image, opt TileOption) image.Rectangle {
+	bounds := src.Bounds()
+	if opt.Fit != "Crop" {
+		return bounds
+	}
+
+	lenx := bounds.Dx()
+	leny := bounds.Dy()
+	if lenx*opt.Height > leny*opt.Width {
+		lenx = leny * opt.Width / opt.Height
+	} else {
+		leny = lenx * opt.Height / opt.Width
+	}
+	startx := bounds.Min.X + (bounds.Dx()-lenx)/2
+	starty := bounds.Min.Y + (bounds.Dy()-leny)/2
+
+	if opt.Crop != "Center" && (lenx != bounds.Dx() || leny != bounds.Dy()) {
+		small := scale_down(src, cropAnalysisSize)
+		horizontal := lenx != bounds.Dx()
+
+		n := small.Bounds().Dy()
+		win := leny * n / bounds.Dy()
+		if horizontal {
+			n = small.Bounds().Dx()
+			win = lenx * n / bounds.Dx()
+		}
+		win = maxInt(minInt(win, n), 1)
+
+		best := crop_best(crop_lines(small, horizontal, opt.Crop), win, opt.Crop == "Entropy")
+		if horizontal {
+			startx = minInt(bounds.Min.X+best*bounds.Dx()/n, bounds.Max.X-lenx)
+		} else {
+			starty = minInt(bounds.Min.Y+best*bounds.Dy()/n, bounds.Max.Y-leny)
+		}
+	}
+
+	return image.Rect(startx, starty, startx+lenx, starty+leny)
+}
+
+func isFit(fit string) bool {
+	return fit == "Crop" || fit == "Pad" || fit == "Blur"
+}
+
+// fit_img scales the whole src into a tile, the space left is filled with the avg color of src (Pad)
+// or with a blurred copy of src that covers the tile (Blur)
+func fit_img(src image.Image, filename string, opt TileOption) (image.Image, error) {
+	bounds := src.Bounds()
+
+	fitx := opt.Width
+	fity := opt.Height
+	if bounds.Dx()*opt.Height > bounds.Dy()*opt.Width {
+		fity = maxInt(bounds.Dy()*opt.Width/bounds.Dx(), 1)
+	} else {
+		fitx = maxInt(bounds.Dx()*opt.Height/bounds.Dy(), 1)
+	}
+
+	if (bounds.Dx() < fitx || bounds.Dy() < fity) && !opt.Upscale {
+		log.Printf("fit_img image too small %s %d*%d %d*%d", filename, bounds.Dx(), bounds.Dy(), fitx, fity)
+		return nil, errors.New("too small")
+	}
+
+	fitted := image.NewRGBA(image.Rect(0, 0, fitx, fity))
+	opt.Scaler.Scale(fitted, fitted.Bounds(), src, bounds, draw.Src, nil)
+
+	rect := image.Rect(0, 0, opt.Width, opt.Height)
+	dst := image.NewRGBA(rect)
+	if opt.Fit == "Blur" {
+		cover := opt
+		cover.Crop = "Center"
+		cover.Fit = "Crop"
+		draw.ApproxBiLinear.Scale(dst, rect, src, crop_box(src, cover), draw.Src, nil)
+		box_blur(dst, maxInt(maxInt(opt.Width, opt.Height)/8, 1))
+	} else {
+		avg := avg_color(fitted)
+		avg.A = 255
+		draw.Draw(dst, rect, &image.Uniform{avg}, image.Point{}, draw.Src)
+	}
+	draw.Copy(dst, image.Point{(opt.Width - fitx) / 2, (opt.Height - fity) / 2}, fitted, fitted.Bounds(), draw.Src, nil)
+
+	return dst, nil
+}
+
+// box_blur blurs img in place with two passes of a separable box filter of radius r
+func box_blur(img *image.RGBA, r int) {
+	bounds := img.Bounds()
+	tmp := make([]uint8, len(img.Pix))
+	for pass := 0; pass < 4; pass++ {
+		horizontal := pass%2 == 0
+		copy(tmp, img.Pix)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				var sum [4]int
+				n := 0
+				for d := -r; d <= r; d++ {
+					sx, sy := x, y
+					if horizontal {
+						sx = maxInt(bounds.Min.X, minInt(x+d, bounds.Max.X-1))
+					} else {
+						sy = maxInt(bounds.Min.Y, minInt(y+d, bounds.Max.Y-1))
+					}
+					i := img.PixOffset(sx, sy)
+					for c := 0; c < 4; c++ {
+						sum[c] += int(tmp[i+c])
+					}
+					n++
+				}
+				i := img.PixOffset(x, y)
+				for c := 0; c < 4; c++ {
+					img.Pix[i+c] = uint8(sum[c] / n)
+				}
+			}
+		}
+	}
+}
+
+func scale_down(src image.Image, size int) *image.RGBA {
+	bounds := src.Bounds()
+	len := maxInt(bounds.Dx(), bounds.Dy())
+	lenx := maxInt(bounds.Dx()*minInt(size, len)/len, 1)
+	leny := maxInt(bounds.Dy()*minInt(size, len)/len, 1)
+	dst := image.NewRGBA(image.Rect(0, 0, lenx, leny))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+	return dst
+}
+
+// cropLine is what one column (or row) of the analysis pic adds to a crop window
+type cropLine struct {
+	score float64
+	hist  [32]int
+}
+
+func crop_lines(img *image.RGBA, horizontal bool, crop string) []cropLine {
+	bounds := img.Bounds()
+	n := bounds.Dy()
+	if horizontal {
+		n = bounds.Dx()
+	}
+	lines := make([]cropLine, n)
+
+	lum := func(x, y int) float64 {
+		x = maxInt(bounds.Min.X, minInt(x, bounds.Max.X-1))
+		y = maxInt(bounds.Min.Y, minInt(y, bounds.Max.Y-1))
+		c := img.RGBAAt(x, y)
+		return 0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)
+	}
+
+	skin := 0.0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			i := y - bounds.Min.Y
+			if horizontal {
+				i = x - bounds.Min.X
+			}
+
+			switch crop {
+			case "Entropy":
+				lines[i].hist[int(lum(x, y))/8]++
+			case "Edge":
+				lines[i].score += math.Abs(lum(x+1, y)-lum(x-1, y)) + math.Abs(lum(x, y+1)-lum(x, y-1))
+			case "Skin":
+				if is_skin(img.RGBAAt(x, y)) {
+					lines[i].score++
+					skin++
+				}
+			}
+		}
+	}
+
+	if crop == "Skin" && skin == 0 {
+		return crop_lines(img, horizontal, "Edge")
+	}
+
+	return lines
+}
+
+// crop_best returns the start of the win lines long window with the best score, ties go to the one nearest the middle
+func crop_best(lines []cropLine, win int, entropy bool) int {
+	center := (len(lines) - win) / 2
+	best := center
+	bestscore := math.Inf(-1)
+	for start := 0; start+win <= len(lines); start++ {
+		var score float64
+		if entropy {
+			var hist [32]int
+			total := 0
+			for _, l := range lines[start : start+win] {
+				for i, v := range l.hist {
+					hist[i] += v
+					total += v
+				}
+			}
+			for _, v := range hist {
+				if v > 0 {
+					p := float64(v) / float64(total)
+					score -= p * math.Log2(p)
+				}
+			}
+		} else {
+			for _, l := range lines[start : start+win] {
+				score += l.score
+			}
+		}
+
+		if score > bestscore+1e-9 || (math.Abs(score-bestscore) <= 1e-9 && absInt(start-center) < absInt(best-center)) {
+			best = start
+			bestscore = score
+		}
+	}
+	return best
+}
+
+// is_skin is the classic RGB skin rule of Peer et al
+func is_skin(c color.RGBA) bool {
+	r, g, b := int(c.R), int(c.G), int(c.B)
+	return r > 95 && g > 40 && b > 20 &&
+		maxInt(r, maxInt(g, b))-minInt(r, minInt(g, b)) > 15 &&
+		absInt(r-g) > 15 && r > g && r > b
+}
+
+func absInt(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
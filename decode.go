@@ -0,0 +1,230 @@
+package mosaic
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// sniff_format returns the format of the pic or archive in filename by its first bytes, "" when it is neither
+func sniff_format(libfs fs.FS, filename string) (string, error) {
+	reader, err := libfs.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(reader, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte("\xff\xd8\xff")):
+		return "jpeg", nil
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return "png", nil
+	case bytes.HasPrefix(head, []byte("GIF87a")) || bytes.HasPrefix(head, []byte("GIF89a")):
+		return "gif", nil
+	case bytes.HasPrefix(head, []byte("BM")):
+		return "bmp", nil
+	case bytes.HasPrefix(head, []byte("II*\x00")) || bytes.HasPrefix(head, []byte("MM\x00*")):
+		return "tiff", nil
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		return "webp", nil
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")) || bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return "zip", nil
+	case bytes.HasPrefix(head, []byte("\x1f\x8b")):
+		return "gzip", nil
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return "tar", nil
+	}
+	return "", nil
+}
+
+// decode_img decodes the pic in r, turned upright by its EXIF orientation and converted to sRGB by its ICC profile
+func decode_img(r io.Reader) (image.Image, string, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		metricDecodeFailure.Add(1)
+		return nil, format, err
+	}
+
+	orientation := 1
+	var profile []byte
+	switch format {
+	case "jpeg":
+		orientation, profile = jpeg_meta(data)
+	case "png":
+		profile = png_iccp(data)
+	}
+
+	if len(profile) > 0 {
+		icc, err := parse_icc(profile)
+		if err != nil {
+			log.Printf("decode_img parse_icc fail %s", err)
+		} else if icc != nil {
+			img = icc.to_srgb(img)
+		}
+	}
+
+	return orient(img, orientation), format, nil
+}
+
+// orient turns img upright by the EXIF orientation, 1 is upright
+func orient(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return TransformFlipH.Apply(img)
+	case 3:
+		return TransformRot180.Apply(img)
+	case 4:
+		return TransformFlipV.Apply(img)
+	case 5:
+		return TransformFlipH.Apply(TransformRot90.Apply(img))
+	case 6:
+		return TransformRot90.Apply(img)
+	case 7:
+		return TransformFlipH.Apply(TransformRot270.Apply(img))
+	case 8:
+		return TransformRot270.Apply(img)
+	}
+	return img
+}
+
+// jpeg_meta returns the EXIF orientation and the ICC profile of the jpeg in data
+func jpeg_meta(data []byte) (int, []byte) {
+	orientation := 1
+	var chunks [][]byte
+
+	i := 2
+	for i+4 <= len(data) && data[i] == 0xff {
+		marker := data[i+1]
+		if marker == 0xd8 || marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			i += 2
+			continue
+		}
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			break
+		}
+		seg := data[i+4 : i+2+length]
+
+		if marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			orientation = exif_orientation(seg[6:])
+		}
+		if marker == 0xe2 && bytes.HasPrefix(seg, []byte("ICC_PROFILE\x00")) && len(seg) >= 14 {
+			seq, count := int(seg[12]), int(seg[13])
+			if chunks == nil {
+				chunks = make([][]byte, count)
+			}
+			if seq >= 1 && seq <= len(chunks) {
+				chunks[seq-1] = seg[14:]
+			}
+		}
+
+		i += 2 + length
+	}
+
+	var profile []byte
+	for _, chunk := range chunks {
+		if chunk == nil {
+			return orientation, nil
+		}
+		profile = append(profile, chunk...)
+	}
+	return orientation, profile
+}
+
+// exif_orientation reads the orientation tag from the first IFD of the EXIF tiff in data
+func exif_orientation(data []byte) int {
+	if len(data) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	if order.Uint16(data[2:]) != 42 {
+		return 1
+	}
+
+	ifd := int(order.Uint32(data[4:]))
+	if ifd+2 > len(data) {
+		return 1
+	}
+	n := int(order.Uint16(data[ifd:]))
+	for i := 0; i < n; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(data) {
+			break
+		}
+		if order.Uint16(data[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(data[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// png_iccp returns the ICC profile of the png in data
+func png_iccp(data []byte) []byte {
+	i := 8
+	for i+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		typ := string(data[i+4 : i+8])
+		if length < 0 || i+12+length > len(data) || typ == "IDAT" {
+			break
+		}
+
+		if typ == "iCCP" {
+			body := data[i+8 : i+8+length]
+			name := bytes.IndexByte(body, 0)
+			if name < 0 || name+2 > len(body) {
+				return nil
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(body[name+2:]))
+			if err != nil {
+				return nil
+			}
+			defer zr.Close()
+			profile, err := ioutil.ReadAll(zr)
+			if err != nil {
+				return nil
+			}
+			return profile
+		}
+
+		i += 12 + length
+	}
+	return nil
+}
@@ -0,0 +1,535 @@
+package mosaic
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/chyroc/go-ptr"
+)
+
+// exif_segment returns an APP1 segment with an EXIF tiff holding the orientation tag
+func exif_segment(order binary.ByteOrder, orientation uint16) []byte {
+	tiff := make([]byte, 8+2+12+4)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], 0x0112)
+	order.PutUint16(tiff[12:], 3)
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], orientation)
+	return jpeg_segment(0xe1, append([]byte("Exif\x00\x00"), tiff...))
+}
+
+// icc_segment returns the APP2 segment holding chunk seq of count of an ICC profile
+func icc_segment(seq int, count int, chunk []byte) []byte {
+	return jpeg_segment(0xe2, append([]byte{'I', 'C', 'C', '_', 'P', 'R', 'O', 'F', 'I', 'L', 'E', 0, byte(seq), byte(count)}, chunk...))
+}
+
+func jpeg_segment(marker byte, body []byte) []byte {
+	return append([]byte{0xff, marker, byte((len(body) + 2) >> 8), byte(len(body) + 2)}, body...)
+}
+
+// test_jpeg returns a jpeg of img with segments right after its SOI marker
+func test_jpeg(t *testing.T, img image.Image, segments ...[]byte) []byte {
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	data := append([]byte{}, b.Bytes()[:2]...)
+	for _, seg := range segments {
+		data = append(data, seg...)
+	}
+	return append(data, b.Bytes()[2:]...)
+}
+
+// upright_pics returns a pic with all its pixels different, and how it is stored with each EXIF orientation
+func upright_pics() (*image.RGBA, map[int]*image.RGBA) {
+	const w, h = 3, 2
+	upright := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			upright.Set(x, y, color.RGBA{uint8(x * 80), uint8(y * 80), 7, 255})
+		}
+	}
+
+	// where the stored pixel c, r is in the upright pic, as the EXIF spec puts the 0th row and 0th column
+	at := map[int]func(c, r int) (int, int){
+		1: func(c, r int) (int, int) { return c, r },
+		2: func(c, r int) (int, int) { return w - 1 - c, r },
+		3: func(c, r int) (int, int) { return w - 1 - c, h - 1 - r },
+		4: func(c, r int) (int, int) { return c, h - 1 - r },
+		5: func(c, r int) (int, int) { return r, c },
+		6: func(c, r int) (int, int) { return w - 1 - r, c },
+		7: func(c, r int) (int, int) { return w - 1 - r, h - 1 - c },
+		8: func(c, r int) (int, int) { return r, h - 1 - c },
+	}
+	stored := map[int]*image.RGBA{}
+	for orientation, f := range at {
+		sw, sh := w, h
+		if orientation >= 5 {
+			sw, sh = h, w
+		}
+		s := image.NewRGBA(image.Rect(0, 0, sw, sh))
+		for r := 0; r < sh; r++ {
+			for c := 0; c < sw; c++ {
+				x, y := f(c, r)
+				s.Set(c, r, upright.At(x, y))
+			}
+		}
+		stored[orientation] = s
+	}
+	return upright, stored
+}
+
+func TestOrient(t *testing.T) {
+	upright, stored := upright_pics()
+	for orientation := 1; orientation <= 8; orientation++ {
+		got := orient(stored[orientation], orientation)
+		if got.Bounds().Size() != upright.Bounds().Size() {
+			t.Fatalf("orientation %d: size %v", orientation, got.Bounds().Size())
+		}
+		for y := 0; y < upright.Bounds().Dy(); y++ {
+			for x := 0; x < upright.Bounds().Dx(); x++ {
+				if color.RGBAModel.Convert(got.At(got.Bounds().Min.X+x, got.Bounds().Min.Y+y)) != upright.At(x, y) {
+					t.Fatalf("orientation %d: pixel %d,%d not upright", orientation, x, y)
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeImgOrientation(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for orientation := 1; orientation <= 8; orientation++ {
+			data := test_jpeg(t, img, exif_segment(order, uint16(orientation)))
+			if got, _ := jpeg_meta(data); got != orientation {
+				t.Fatalf("%s orientation %d: jpeg_meta %d", order, orientation, got)
+			}
+
+			dec, format, err := decode_img(bytes.NewReader(data))
+			if err != nil || format != "jpeg" {
+				t.Fatalf("%s orientation %d: decode_img %s %s", order, orientation, format, err)
+			}
+			want := image.Pt(16, 8)
+			if orientation >= 5 {
+				want = image.Pt(8, 16)
+			}
+			if dec.Bounds().Size() != want {
+				t.Fatalf("%s orientation %d: size %v want %v", order, orientation, dec.Bounds().Size(), want)
+			}
+		}
+	}
+}
+
+func TestJpegMetaMalformed(t *testing.T) {
+	exif := func(tiff []byte) []byte { return jpeg_segment(0xe1, append([]byte("Exif\x00\x00"), tiff...)) }
+	valid := exif_segment(binary.BigEndian, 6)
+	profile := bytes.Repeat([]byte{1, 2, 3}, 10)
+
+	for _, tt := range []struct {
+		name        string
+		segments    [][]byte
+		orientation int
+		profile     []byte
+	}{
+		{"none", nil, 1, nil},
+		{"length past end", [][]byte{{0xff, 0xe1, 0x7f, 0xff, 'E', 'x', 'i', 'f'}}, 1, nil},
+		{"length below 2", [][]byte{{0xff, 0xe1, 0x00, 0x01}, valid}, 1, nil},
+		{"tiff too short", [][]byte{exif([]byte("MM\x00*"))}, 1, nil},
+		{"bad byte order", [][]byte{exif([]byte("XX\x00*\x00\x00\x00\x08\x00\x00"))}, 1, nil},
+		{"bad magic", [][]byte{exif([]byte("MM\x00+\x00\x00\x00\x08\x00\x00"))}, 1, nil},
+		{"ifd past end", [][]byte{exif([]byte("MM\x00*\xff\xff\xff\xf0\x00\x00"))}, 1, nil},
+		{"entries past end", [][]byte{exif([]byte("MM\x00*\x00\x00\x00\x08\x00\x09\x01\x12\x00\x03"))}, 1, nil},
+		{"orientation 0", [][]byte{exif_segment(binary.BigEndian, 0)}, 1, nil},
+		{"orientation 9", [][]byte{exif_segment(binary.LittleEndian, 9)}, 1, nil},
+		{"not exif", [][]byte{jpeg_segment(0xe1, []byte("http://ns.adobe.com/xap/1.0/\x00"))}, 1, nil},
+		{"exif after junk segment", [][]byte{jpeg_segment(0xe0, []byte("JFIF\x00")), valid}, 6, nil},
+		{"icc in order", [][]byte{icc_segment(1, 2, profile[:7]), icc_segment(2, 2, profile[7:])}, 1, profile},
+		{"icc out of order", [][]byte{icc_segment(2, 2, profile[7:]), valid, icc_segment(1, 2, profile[:7])}, 6, profile},
+		{"icc chunk missing", [][]byte{icc_segment(1, 2, profile)}, 1, nil},
+		{"icc seq out of range", [][]byte{icc_segment(3, 2, profile)}, 1, nil},
+		{"icc seq 0", [][]byte{icc_segment(0, 1, profile)}, 1, nil},
+		{"icc count 0", [][]byte{icc_segment(1, 0, profile)}, 1, nil},
+		{"icc header short", [][]byte{jpeg_segment(0xe2, []byte("ICC_PROFILE\x00\x01"))}, 1, nil},
+	} {
+		data := []byte{0xff, 0xd8}
+		for _, seg := range tt.segments {
+			data = append(data, seg...)
+		}
+		data = append(data, 0xff, 0xda, 0, 2)
+
+		orientation, profile := jpeg_meta(data)
+		if orientation != tt.orientation || !bytes.Equal(profile, tt.profile) {
+			t.Errorf("%s: got %d %v want %d %v", tt.name, orientation, profile, tt.orientation, tt.profile)
+		}
+	}
+
+	// no cut of the head of a jpeg makes the parse go out of bounds
+	data := test_jpeg(t, image.NewRGBA(image.Rect(0, 0, 8, 8)), valid, icc_segment(1, 2, profile[:7]), icc_segment(2, 2, profile[7:]))
+	for n := range data {
+		jpeg_meta(data[:n])
+	}
+}
+
+// icc_profile returns a matrix/TRC RGB profile with the D50 XYZ of the primaries as columns and one trc for all channels
+func icc_profile(primaries [3][3]float64, trc []byte) []byte {
+	fixed := func(v float64) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(int32(math.Round(v*65536))))
+		return b
+	}
+
+	var tags [][2]interface{}
+	for c, name := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		xyz := []byte("XYZ \x00\x00\x00\x00")
+		for k := 0; k < 3; k++ {
+			xyz = append(xyz, fixed(primaries[k][c])...)
+		}
+		tags = append(tags, [2]interface{}{name, xyz})
+	}
+	for _, name := range []string{"rTRC", "gTRC", "bTRC"} {
+		tags = append(tags, [2]interface{}{name, trc})
+	}
+
+	profile := make([]byte, 132+12*len(tags))
+	copy(profile[12:], "mntr")
+	copy(profile[16:], "RGB ")
+	copy(profile[20:], "XYZ ")
+	copy(profile[36:], "acsp")
+	binary.BigEndian.PutUint32(profile[128:], uint32(len(tags)))
+	for i, tag := range tags {
+		data := tag[1].([]byte)
+		entry := 132 + i*12
+		copy(profile[entry:], tag[0].(string))
+		binary.BigEndian.PutUint32(profile[entry+4:], uint32(len(profile)))
+		binary.BigEndian.PutUint32(profile[entry+8:], uint32(len(data)))
+		profile = append(profile, data...)
+		for len(profile)%4 != 0 {
+			profile = append(profile, 0)
+		}
+	}
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+	return profile
+}
+
+// para_trc returns a para tone curve of type 3, the one of sRGB and Display P3
+func para_trc(g, a, b, c, d float64) []byte {
+	trc := []byte("para\x00\x00\x00\x00\x00\x03\x00\x00")
+	for _, v := range []float64{g, a, b, c, d} {
+		p := make([]byte, 4)
+		binary.BigEndian.PutUint32(p, uint32(int32(math.Round(v*65536))))
+		trc = append(trc, p...)
+	}
+	return trc
+}
+
+// the tags of the Display P3 profile of macOS, and of sRGB, primaries adapted to D50
+var (
+	srgbTRC         = para_trc(2.39999390, 0.94786072, 0.05213928, 0.07739258, 0.04045105)
+	displayP3Matrix = [3][3]float64{
+		{0.51512146, 0.29197693, 0.15710449},
+		{0.24119568, 0.69224548, 0.06657410},
+		{-0.00105286, 0.04188538, 0.78407288},
+	}
+	srgbMatrix = [3][3]float64{
+		{0.43606567, 0.38514709, 0.14306641},
+		{0.22248840, 0.71687317, 0.06060791},
+		{0.01391602, 0.09707642, 0.71409607},
+	}
+)
+
+func TestParseICCDisplayP3(t *testing.T) {
+	icc, err := parse_icc(icc_profile(displayP3Matrix, srgbTRC))
+	if err != nil || icc == nil {
+		t.Fatalf("parse_icc %v %s", icc, err)
+	}
+
+	// sRGB red and green are color(display-p3 0.9175 0.2003 0.1386) and color(display-p3 0.4584 0.9853 0.2983)
+	for _, tt := range []struct {
+		p3, srgb color.RGBA
+	}{
+		{color.RGBA{234, 51, 35, 255}, color.RGBA{255, 0, 0, 255}},
+		{color.RGBA{117, 251, 76, 255}, color.RGBA{0, 255, 0, 255}},
+		{color.RGBA{128, 128, 128, 255}, color.RGBA{128, 128, 128, 255}},
+		{color.RGBA{0, 0, 0, 0}, color.RGBA{0, 0, 0, 0}},
+	} {
+		src := image.NewRGBA(image.Rect(0, 0, 1, 1))
+		src.SetRGBA(0, 0, tt.p3)
+		got := icc.to_srgb(src).(*image.RGBA).RGBAAt(0, 0)
+		for c, v := range []uint8{got.R, got.G, got.B, got.A} {
+			want := []uint8{tt.srgb.R, tt.srgb.G, tt.srgb.B, tt.srgb.A}[c]
+			if math.Abs(float64(v)-float64(want)) > 3 {
+				t.Fatalf("p3 %v to srgb %v want %v", tt.p3, got, tt.srgb)
+			}
+		}
+		if src.RGBAAt(0, 0) != tt.p3 {
+			t.Fatalf("to_srgb changed its src")
+		}
+	}
+
+	// an sRGB profile needs no conversion
+	icc, err = parse_icc(icc_profile(srgbMatrix, srgbTRC))
+	if err != nil || icc != nil {
+		t.Fatalf("parse_icc srgb %v %s", icc, err)
+	}
+}
+
+func TestParseICCMalformed(t *testing.T) {
+	p3 := icc_profile(displayP3Matrix, srgbTRC)
+
+	gray := append([]byte{}, p3...)
+	copy(gray[16:], "GRAY")
+	badoffset := append([]byte{}, p3...)
+	binary.BigEndian.PutUint32(badoffset[132+4:], uint32(len(p3)))
+	badcount := append([]byte{}, p3...)
+	binary.BigEndian.PutUint32(badcount[128:], 1<<30)
+	notrc := append([]byte{}, p3...)
+	binary.BigEndian.PutUint32(notrc[128:], 3)
+	badxyz := append([]byte{}, p3...)
+	copy(badxyz[binary.BigEndian.Uint32(p3[132+4:]):], "XYZX")
+
+	for _, tt := range []struct {
+		name    string
+		profile []byte
+		nilicc  bool
+		err     bool
+	}{
+		{"short", p3[:100], true, true},
+		{"not rgb", gray, true, false},
+		{"tag past end", badoffset, true, true},
+		{"tag count past end", badcount, true, true},
+		{"bad xyz", badxyz, true, true},
+		{"no trc", notrc, true, false},
+		{"bad trc", icc_profile(displayP3Matrix, []byte("curv\x00\x00\x00\x00\x00\x00\x00\x09")), true, true},
+	} {
+		icc, err := parse_icc(tt.profile)
+		if (icc == nil) != tt.nilicc || (err != nil) != tt.err {
+			t.Errorf("%s: got %v %v", tt.name, icc, err)
+		}
+	}
+
+	// no cut of a profile makes the parse go out of bounds
+	for n := range p3 {
+		parse_icc(p3[:n])
+	}
+}
+
+func TestParseTRC(t *testing.T) {
+	curv := func(values ...uint16) []byte {
+		tag := make([]byte, 12+2*len(values))
+		copy(tag, "curv")
+		binary.BigEndian.PutUint32(tag[8:], uint32(len(values)))
+		for i, v := range values {
+			binary.BigEndian.PutUint16(tag[12+i*2:], v)
+		}
+		return tag
+	}
+
+	for _, tt := range []struct {
+		name string
+		tag  []byte
+		in   float64
+		out  float64
+	}{
+		{"identity", curv(), 0.3, 0.3},
+		{"gamma 2", curv(512), 0.5, 0.25},
+		{"table", curv(0, 65535/4, 65535), 0.75, 0.625},
+		{"table end", curv(0, 65535/4, 65535), 1, 1},
+		{"para gamma", []byte("para\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x00"), 0.5, 0.25},
+		{"srgb", srgbTRC, 0.5, 0.2140},
+		{"srgb linear part", srgbTRC, 0.02, 0.02 / 12.92},
+	} {
+		f, err := parse_trc(tt.tag)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if got := f(tt.in); math.Abs(got-tt.out) > 0.001 {
+			t.Fatalf("%s: f(%v) %v want %v", tt.name, tt.in, got, tt.out)
+		}
+	}
+
+	for _, tag := range [][]byte{
+		[]byte("curv\x00\x00\x00\x00"),
+		curv(1, 2, 3)[:14],
+		[]byte("para\x00\x00\x00\x00\x00\x05\x00\x00\x00\x00\x00\x00"),
+		srgbTRC[:20],
+		[]byte("sf32\x00\x00\x00\x00\x00\x00\x00\x00"),
+	} {
+		if _, err := parse_trc(tag); err == nil {
+			t.Fatalf("parse_trc %q did not fail", tag)
+		}
+	}
+}
+
+// png_chunk returns a png chunk of type typ
+func TestPngICCP(t *testing.T) {
+	profile := icc_profile(displayP3Matrix, srgbTRC)
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write(profile)
+	zw.Close()
+
+	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	img.SetRGBA(0, 0, color.RGBA{234, 51, 35, 255})
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	plain := b.Bytes()
+	withiccp := func(body []byte) []byte {
+		data := append([]byte{}, plain[:pngIHDREnd]...)
+		data = append(data, png_chunk("iCCP", body)...)
+		return append(data, plain[pngIHDREnd:]...)
+	}
+	data := withiccp(append([]byte("Display P3\x00\x00"), z.Bytes()...))
+
+	if got := png_iccp(data); !bytes.Equal(got, profile) {
+		t.Fatalf("png_iccp got %d bytes want %d", len(got), len(profile))
+	}
+	dec, _, err := decode_img(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, _, _ := dec.At(0, 0).RGBA(); r>>8 < 250 || g>>8 > 5 {
+		t.Fatalf("p3 pic not converted to srgb %v", dec.At(0, 0))
+	}
+
+	for name, data := range map[string][]byte{
+		"no iccp":     plain,
+		"no name end": withiccp([]byte("Display P3")),
+		"bad zlib":    withiccp([]byte("Display P3\x00\x00garbage")),
+	} {
+		if got := png_iccp(data); got != nil {
+			t.Fatalf("%s: png_iccp got %d bytes", name, len(got))
+		}
+	}
+
+	for n := range data {
+		png_iccp(data[:n])
+	}
+}
+
+func TestSniffFormat(t *testing.T) {
+	img := test_src(6, 4)
+	encode := func(format string) []byte {
+		var b bytes.Buffer
+		if err := encode_target(&b, img, format, EncodeOption{JpegQuality: 90}); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+	var gifdata, tardata bytes.Buffer
+	gif.Encode(&gifdata, img, nil)
+	tw := tar.NewWriter(&tardata)
+	tw.WriteHeader(&tar.Header{Name: "a.png", Mode: 0o644, Size: 3})
+	tw.Write([]byte("abc"))
+	tw.Close()
+	mmtiff := append([]byte("MM\x00*"), make([]byte, 8)...)
+
+	for _, tt := range []struct {
+		name   string
+		data   []byte
+		format string
+		decode bool // the pic decodes whatever its name says
+	}{
+		// the name says nothing, the first bytes do
+		{"photo.png", encode("jpeg"), "jpeg", true},
+		{"noext", encode("png"), "png", true},
+		{"PIC.JPG", encode("png"), "png", true},
+		{"a.gif.txt", gifdata.Bytes(), "gif", true},
+		{"scan", encode("bmp"), "bmp", true},
+		{"scan.dat", encode("tiff"), "tiff", true},
+		{"motorola.tif", mmtiff, "tiff", false},
+		{"image.bin", encode("webp"), "webp", true},
+		{"pics.jpg", []byte("PK\x03\x04rest"), "zip", false},
+		{"empty.zip", []byte("PK\x05\x06"), "zip", false},
+		{"pics.gz", []byte("\x1f\x8b\x08"), "gzip", false},
+		{"pics", tardata.Bytes(), "tar", false},
+		// no pic or archive
+		{"notes.txt", []byte("no pic"), "", false},
+		{"fake.png", []byte("<html>"), "", false},
+		{"sound.webp", []byte("RIFF\x00\x00\x00\x00WAVEfmt "), "", false},
+		{"short.jpg", []byte("\xff\xd8"), "", false},
+		{"empty.png", nil, "", false},
+	} {
+		lib := fstest.MapFS{tt.name: {Data: tt.data}}
+		format, err := sniff_format(lib, tt.name)
+		if err != nil || format != tt.format {
+			t.Errorf("%s: format %q %v want %q", tt.name, format, err, tt.format)
+		}
+		if tt.decode {
+			dec, _, err := decode_img(bytes.NewReader(tt.data))
+			if err != nil || dec.Bounds().Size() != img.Bounds().Size() {
+				t.Errorf("%s: decode %v", tt.name, err)
+			}
+		}
+	}
+
+	if _, err := sniff_format(fstest.MapFS{}, "missing.png"); err == nil {
+		t.Fatalf("sniff_format of a missing file did not fail")
+	}
+}
+
+func TestIndexUnsupported(t *testing.T) {
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, test_src(24, 24), nil); err != nil {
+		t.Fatal(err)
+	}
+	lib := fstest.MapFS{
+		"lib/jpeg.png":  {Data: jpg.Bytes()},
+		"lib/noext":     {Data: test_pic(t, 1)},
+		"lib/notes.txt": {Data: []byte("no pic")},
+		"lib/text.jpg":  {Data: []byte("no pic either")},
+		"lib/bad.zip":   {Data: []byte("PK\x03\x04broken")},
+		"lib/ok.png":    {Data: test_pic(t, 2)},
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(ioutil.Discard)
+	before := metricUnsupported.Get()
+
+	req := &Request{LibFS: lib, Lib: "lib", Database: ptr.String(filepath.Join(t.TempDir(), "database.bin")), PixelSize: ptr.Int(8), Worker: ptr.Int(2)}
+	if err := Index(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := lib_filenames(t, req); fmt.Sprint(got) != "[lib/jpeg.png lib/noext lib/ok.png]" {
+		t.Fatalf("indexed %v", got)
+	}
+	if n := metricUnsupported.Get() - before; n != 3 {
+		t.Fatalf("%d unsupported files counted", n)
+	}
+	for _, want := range []string{
+		"load_lib unsupported file lib/bad.zip\n",
+		"load_lib unsupported file lib/notes.txt\n",
+		"load_lib unsupported file lib/text.jpg\n",
+		"load_lib summary new 3 cached 0 failed 0 unsupported 3\n",
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Fatalf("no %q in the log", strings.TrimSpace(want))
+		}
+	}
+}
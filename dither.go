@@ -0,0 +1,114 @@
+package mosaic
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"log"
+	"math"
+	"sort"
+	"sync/atomic"
+)
+
+// ditherWeights is how Floyd-Steinberg spreads the error of a cell, in cells right and below it
+var ditherWeights = []struct {
+	dx     int
+	dy     int
+	weight float64
+}{
+	{1, 0, 7.0 / 16},
+	{-1, 1, 3.0 / 16},
+	{0, 1, 5.0 / 16},
+	{1, 1, 1.0 / 16},
+}
+
+// dither_cells matches the cells top to bottom, left to right, and adds the difference between the color each
+// cell wanted and the avg color of its tile to the src pixels of the cells right and below it before they are matched,
+// the color of every cell is changed in place and its tile is kept in cell.Match, so it is not matched again when drawn
+func dither_cells(ctx context.Context, cells []Cell, srcw int, srch int, opt TileOption, fis []FileInfo, transforms []Transform, seed int64, mc *MatchCache) error {
+	order := make([]int, len(cells))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := cells[order[i]].Rect.Min, cells[order[j]].Rect.Min
+		return a.Y < b.Y || (a.Y == b.Y && a.X < b.X)
+	})
+
+	grid := image.Rect(0, 0, srcw, srch)
+	errs := make([][3]float64, srcw*srch)
+
+	var done int32
+	stop := every_second(func() {
+		log.Printf("dither progress=%d/%d", atomic.LoadInt32(&done), len(cells))
+	})
+	defer stop()
+
+	for _, i := range order {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		cell := &cells[i]
+
+		// the src pixels under the cell
+		r := image.Rect(
+			int(math.Floor(float64(cell.Rect.Min.X)/float64(opt.Width))),
+			int(math.Floor(float64(cell.Rect.Min.Y)/float64(opt.Height))),
+			int(math.Ceil(float64(cell.Rect.Max.X)/float64(opt.Width))),
+			int(math.Ceil(float64(cell.Rect.Max.Y)/float64(opt.Height))),
+		)
+
+		var e [3]float64
+		in := r.Intersect(grid)
+		if !in.Empty() {
+			for y := in.Min.Y; y < in.Max.Y; y++ {
+				for x := in.Min.X; x < in.Max.X; x++ {
+					for c := 0; c < 3; c++ {
+						e[c] += errs[y*srcw+x][c]
+					}
+				}
+			}
+			for c := 0; c < 3; c++ {
+				e[c] /= float64(in.Dx() * in.Dy())
+			}
+		}
+
+		cell.C = add_error(cell.C, e)
+		for j := range cell.Grid {
+			cell.Grid[j] = add_error(cell.Grid[j], e)
+		}
+
+		fi, transform, _, err := match_cell(*cell, fis, transforms, seed, mc)
+		if err != nil {
+			return err
+		}
+		cell.Match = &Match{FileInfo: fi, Transform: transform}
+		atomic.AddInt32(&done, 1)
+
+		d := [3]float64{
+			float64(cell.C.R) - float64(fi.R),
+			float64(cell.C.G) - float64(fi.G),
+			float64(cell.C.B) - float64(fi.B),
+		}
+		for _, w := range ditherWeights {
+			next := r.Add(image.Point{w.dx * r.Dx(), w.dy * r.Dy()}).Intersect(grid)
+			for y := next.Min.Y; y < next.Max.Y; y++ {
+				for x := next.Min.X; x < next.Max.X; x++ {
+					for c := 0; c < 3; c++ {
+						errs[y*srcw+x][c] += d[c] * w.weight
+					}
+				}
+			}
+		}
+	}
+
+	log.Printf("dither ok %d", len(cells))
+	return nil
+}
+
+func add_error(c color.RGBA, e [3]float64) color.RGBA {
+	clamp := func(v uint8, e float64) uint8 {
+		return uint8(math.Max(0, math.Min(255, math.Round(float64(v)+e))))
+	}
+	return color.RGBA{clamp(c.R, e[0]), clamp(c.G, e[1]), clamp(c.B, e[2]), c.A}
+}
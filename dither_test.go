@@ -0,0 +1,71 @@
+package mosaic
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDitherCells(t *testing.T) {
+	const n = 16
+	opt := TileOption{Width: 4, Height: 4}
+	fis := []FileInfo{{Filename: "black"}, {Filename: "white", R: 255, G: 255, B: 255}}
+	transforms := []Transform{TransformNone}
+
+	// a flat dark gray src, nearer to black than to white
+	gray := color.RGBA{100, 100, 100, 255}
+	new_cells := func() []Cell {
+		var cells []Cell
+		for y := 0; y < n; y++ {
+			for x := 0; x < n; x++ {
+				cell := Cell{X: x, Y: y, Size: 1, C: gray, Grid: [4]color.RGBA{gray, gray, gray, gray}}
+				cell.Rect = image.Rect(x*opt.Width, y*opt.Height, (x+1)*opt.Width, (y+1)*opt.Height)
+				cells = append(cells, cell)
+			}
+		}
+		return cells
+	}
+
+	// undithered every cell takes the nearest tile
+	plain := new_cells()
+	mc := NewMatchCache()
+	for _, cell := range plain {
+		fi, _, _, err := match_cell(cell, fis, transforms, 42, mc)
+		if err != nil || fi.Filename != "black" {
+			t.Fatalf("cell %d,%d matched %s %v", cell.X, cell.Y, fi.Filename, err)
+		}
+	}
+
+	var runs [2][]string
+	for run := range runs {
+		cells := new_cells()
+		if err := dither_cells(context.Background(), cells, n, n, opt, fis, transforms, 42, NewMatchCache()); err != nil {
+			t.Fatal(err)
+		}
+		for _, cell := range cells {
+			if cell.Match == nil {
+				t.Fatalf("cell %d,%d has no match kept", cell.X, cell.Y)
+			}
+			runs[run] = append(runs[run], cell.Match.FileInfo.Filename)
+		}
+	}
+
+	// the error of each black cell pushes the cells after it to white, about as often as the gray is bright
+	white := 0
+	for i, name := range runs[0] {
+		if name != runs[1][i] {
+			t.Fatalf("cell %d is %s then %s", i, name, runs[1][i])
+		}
+		if name == "white" {
+			white++
+		}
+	}
+	if want := n * n * 100 / 255; white < want-n || white > want+n {
+		t.Fatalf("%d white cells, want about %d", white, want)
+	}
+	// 100 plus 7/16 of the error 100 of the first cell is nearer to white, which leaves 51 for the third
+	if runs[0][0] != "black" || runs[0][1] != "white" || runs[0][2] != "black" {
+		t.Fatalf("first row starts %v", runs[0][:3])
+	}
+}
@@ -4,8 +4,8 @@ go 1.16
 
 require (
 	github.com/OneOfOne/xxhash v1.2.8
-	github.com/boltdb/bolt v1.3.1
-	github.com/chyroc/go-ptr v1.3.1 // indirect
+	github.com/chyroc/go-ptr v1.3.1
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/image v0.0.0-20210628002857-a66eb6448b8d
 	golang.org/x/sys v0.0.0-20210819135213-f52c844e1c1c // indirect
 )
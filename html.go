@@ -0,0 +1,274 @@
+package mosaic
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"html/template"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// htmlFile is a lib pic shown by the html page, Thumb is its tile, the urls of copies are relative to the page
+type htmlFile struct {
+	Name  string `json:"name"`
+	URL   string `json:"url"`
+	Thumb string `json:"thumb"`
+}
+
+var htmlTemplate = template.Must(template.New("html").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { margin: 0; background: #111; font-family: sans-serif; }
+#mosaic { position: relative; display: inline-block; }
+#target { display: block; max-width: 100vw; cursor: pointer; }
+#hover { position: absolute; display: none; pointer-events: none; border: 2px solid #fff; box-sizing: border-box; }
+#tip { position: fixed; display: none; pointer-events: none; max-width: 240px; padding: 6px; background: rgba(0, 0, 0, 0.8); color: #fff; font-size: 12px; word-break: break-all; }
+#thumb { display: block; max-width: 228px; max-height: 228px; margin-bottom: 4px; }
+</style>
+</head>
+<body>
+<div id="mosaic"><img id="target" src="{{.Target}}" alt="{{.Title}}"><div id="hover"></div></div>
+<div id="tip"><img id="thumb" alt=""><span id="label"></span></div>
+<script>
+var width = {{.Width}};
+var files = {{.Files}};
+// left, top, right, bottom in target pixels, index in files
+var tiles = {{.Tiles}};
+
+var target = document.getElementById("target");
+var hover = document.getElementById("hover");
+var tip = document.getElementById("tip");
+var thumb = document.getElementById("thumb");
+var label = document.getElementById("label");
+var current = -1;
+
+// find returns the tile at x, y, the one with the closest center where tiles overlap
+function find(x, y) {
+  var best = -1, bestd = Infinity;
+  for (var i = 0; i < tiles.length; i++) {
+    var t = tiles[i];
+    if (x < t[0] || y < t[1] || x >= t[2] || y >= t[3]) {
+      continue;
+    }
+    var dx = x - (t[0] + t[2]) / 2, dy = y - (t[1] + t[3]) / 2;
+    if (dx * dx + dy * dy < bestd) {
+      best = i;
+      bestd = dx * dx + dy * dy;
+    }
+  }
+  return best;
+}
+
+target.addEventListener("mousemove", function (e) {
+  var scale = target.clientWidth / width;
+  var i = find(e.offsetX / scale, e.offsetY / scale);
+  if (i < 0) {
+    hover.style.display = tip.style.display = "none";
+    current = -1;
+    return;
+  }
+  if (i !== current) {
+    var t = tiles[i], f = files[t[4]];
+    hover.style.left = t[0] * scale + "px";
+    hover.style.top = t[1] * scale + "px";
+    hover.style.width = (t[2] - t[0]) * scale + "px";
+    hover.style.height = (t[3] - t[1]) * scale + "px";
+    thumb.src = f.thumb;
+    label.textContent = f.name;
+    current = i;
+  }
+  hover.style.display = tip.style.display = "block";
+  tip.style.left = Math.min(e.clientX + 16, window.innerWidth - tip.offsetWidth) + "px";
+  tip.style.top = Math.min(e.clientY + 16, window.innerHeight - tip.offsetHeight) + "px";
+});
+
+target.addEventListener("mouseleave", function () {
+  hover.style.display = tip.style.display = "none";
+  current = -1;
+});
+
+target.addEventListener("click", function () {
+  if (current >= 0) {
+    window.open(files[tiles[current][4]].url, "_blank");
+  }
+});
+</script>
+</body>
+</html>
+`))
+
+// write_html writes a page showing target with the tile of each placement on hover, a click opens the lib pic,
+// the tiles, cut from img, and the pics in archives or a LibFS are copied to a _files dir beside the page,
+// so the page keeps working when it is moved with its target and _files dir, the pics on the host are linked
+// by their absolute path, so they only open on this host
+func write_html(htmlpath string, target string, img *image.RGBA, manifest *Manifest, libfs *archiveFS) error {
+	if target == "" {
+		return errors.New("html needs a target file")
+	}
+
+	dir := filepath.Dir(htmlpath)
+	src, err := html_url(dir, target)
+	if err != nil {
+		log.Printf("write_html target url fail %s %s", target, err)
+		return err
+	}
+
+	_, onhost := libfs.base.(hostFS)
+	filesdir := strings.TrimSuffix(htmlpath, filepath.Ext(htmlpath)) + "_files"
+
+	err = os.MkdirAll(filesdir, 0o755)
+	if err != nil {
+		log.Printf("write_html MkdirAll fail %s %s", filesdir, err)
+		return err
+	}
+
+	var files []htmlFile
+	index := make(map[string]int)
+	tiles := make([][5]int, 0, len(manifest.Placements))
+	for _, p := range manifest.Placements {
+		i, ok := index[p.Filename]
+		if !ok {
+			i = len(files)
+			index[p.Filename] = i
+
+			var u, thumb string
+			if onhost && !strings.Contains(p.Filename, archiveSep) {
+				u, err = file_url(p.Filename)
+			} else {
+				u, err = copy_html_file(libfs, p.Filename, filesdir, i)
+				if err == nil {
+					u, err = html_url(dir, u)
+				}
+			}
+			if err == nil {
+				thumb, err = write_html_thumb(img, p.Rect, filesdir, i)
+			}
+			if err == nil {
+				thumb, err = html_url(dir, thumb)
+			}
+			if err != nil {
+				log.Printf("write_html pic url fail %s %s", p.Filename, err)
+				return err
+			}
+			files = append(files, htmlFile{Name: p.Filename, URL: u, Thumb: thumb})
+		}
+		tiles = append(tiles, [5]int{p.Rect.Min.X, p.Rect.Min.Y, p.Rect.Max.X, p.Rect.Max.Y, i})
+	}
+
+	file, err := os.Create(htmlpath)
+	if err != nil {
+		log.Printf("write_html create file fail %s %s", htmlpath, err)
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	err = htmlTemplate.Execute(w, map[string]interface{}{
+		"Title":  filepath.Base(target),
+		"Target": template.URL(src),
+		"Width":  manifest.Width,
+		"Files":  files,
+		"Tiles":  tiles,
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		log.Printf("write_html fail %s %s", htmlpath, err)
+		return err
+	}
+
+	log.Printf("write_html ok %s pics %d tiles %d", htmlpath, len(files), len(tiles))
+	return nil
+}
+
+// html_url returns the url of the file filename relative to dir
+func html_url(dir string, filename string) (string, error) {
+	absdir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	absfile, err := filepath.Abs(filename)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absdir, absfile)
+	if err != nil {
+		return file_url(absfile)
+	}
+	return (&url.URL{Path: filepath.ToSlash(rel)}).String(), nil
+}
+
+// file_url returns the absolute file url of the file filename
+func file_url(filename string) (string, error) {
+	absfile, err := filepath.Abs(filename)
+	if err != nil {
+		return "", err
+	}
+	p := filepath.ToSlash(absfile)
+	if !strings.HasPrefix(p, "/") {
+		// a windows drive
+		p = "/" + p
+	}
+	return (&url.URL{Scheme: "file", Path: p}).String(), nil
+}
+
+// write_html_thumb writes the part rect of img, the tile of the i-th pic, to dir as a png and returns where it is
+func write_html_thumb(img *image.RGBA, rect image.Rectangle, dir string, i int) (string, error) {
+	rect = rect.Intersect(img.Bounds())
+	if rect.Empty() {
+		return "", errors.New("tile out of the target")
+	}
+
+	// the copies of the pics are named i-name, so the tiles never clash with them
+	dst := filepath.Join(dir, fmt.Sprintf("tile-%d.png", i))
+	file, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	err = png.Encode(file, img.SubImage(rect))
+	if err != nil {
+		return "", err
+	}
+	return dst, file.Close()
+}
+
+// copy_html_file copies the lib pic filename to dir as the i-th pic and returns where it is
+func copy_html_file(libfs *archiveFS, filename string, dir string, i int) (string, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return "", err
+	}
+
+	reader, err := libfs.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	dst := filepath.Join(dir, fmt.Sprintf("%d-%s", i, path.Base(filename)))
+	file, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, reader)
+	if err != nil {
+		return "", err
+	}
+	return dst, file.Close()
+}
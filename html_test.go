@@ -0,0 +1,151 @@
+package mosaic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"testing/fstest"
+
+	"github.com/chyroc/go-ptr"
+)
+
+// read_html_page returns the files and tiles of a page written by write_html
+func read_html_page(t *testing.T, htmlpath string) ([]htmlFile, [][5]int) {
+	data, err := os.ReadFile(htmlpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []htmlFile
+	var tiles [][5]int
+	for name, v := range map[string]interface{}{"files": &files, "tiles": &tiles} {
+		m := regexp.MustCompile(`(?m)^var ` + name + ` = (.*);$`).FindSubmatch(data)
+		if m == nil {
+			t.Fatalf("no %s in the page", name)
+		}
+		if err := json.Unmarshal(m[1], v); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+	}
+	return files, tiles
+}
+
+func TestWriteHTML(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib")
+	if err := os.Mkdir(lib, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	write_test_lib(t, lib, 24)
+	mapfs := fstest.MapFS{}
+	for i := 0; i < 24; i++ {
+		mapfs[fmt.Sprintf("lib/%02d.png", i)] = &fstest.MapFile{Data: test_pic(t, i)}
+	}
+
+	for _, libfs := range []string{"host", "LibFS"} {
+		t.Run(libfs, func(t *testing.T) {
+			out := filepath.Join(dir, libfs)
+			if err := os.Mkdir(out, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			req := test_request(lib, filepath.Join(dir, libfs+".bin"), "Hex", 2)
+			if libfs == "LibFS" {
+				req.LibFS, req.Lib = mapfs, "lib"
+			}
+			req.SrcImage = nil
+			req.SrcReader = bytes.NewReader(func() []byte {
+				var b bytes.Buffer
+				png.Encode(&b, test_src(16, 12))
+				return b.Bytes()
+			}())
+			req.Target = filepath.Join(out, "target.png")
+			req.HTML = ptr.String(filepath.Join(out, "page.html"))
+			req.Manifest = ptr.String(filepath.Join(out, "manifest.json"))
+			if err := Mosaic(req); err != nil {
+				t.Fatal(err)
+			}
+			manifest, err := read_manifest(*req.Manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the page, its target and _files dir keep working once moved
+			moved := filepath.Join(dir, libfs+"-moved")
+			if err := os.Rename(out, moved); err != nil {
+				t.Fatal(err)
+			}
+			files, tiles := read_html_page(t, filepath.Join(moved, "page.html"))
+			if len(tiles) != len(manifest.Placements) {
+				t.Fatalf("%d tiles of %d placements", len(tiles), len(manifest.Placements))
+			}
+
+			target, err := os.ReadFile(filepath.Join(moved, "target.png"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			targetimg, err := png.Decode(bytes.NewReader(target))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			seen := map[int]bool{}
+			for i, tile := range tiles {
+				p := manifest.Placements[i]
+				if tile != [5]int{p.Rect.Min.X, p.Rect.Min.Y, p.Rect.Max.X, p.Rect.Max.Y, tile[4]} || files[tile[4]].Name != p.Filename {
+					t.Fatalf("tile %d %v of %+v", i, tile, p)
+				}
+				if seen[tile[4]] {
+					continue
+				}
+				seen[tile[4]] = true
+
+				// the hover shows the tile as it is in the target, not the lib pic
+				f := files[tile[4]]
+				thumb, err := os.ReadFile(filepath.Join(moved, filepath.FromSlash(f.Thumb)))
+				if err != nil {
+					t.Fatalf("thumb of %s: %s", f.Name, err)
+				}
+				img, err := png.Decode(bytes.NewReader(thumb))
+				if err != nil {
+					t.Fatal(err)
+				}
+				rect := p.Rect.Intersect(targetimg.Bounds())
+				if img.Bounds().Size() != rect.Size() {
+					t.Fatalf("thumb of %s is %v want %v", f.Name, img.Bounds(), rect)
+				}
+				for _, pt := range []image.Point{rect.Min, rect.Max.Sub(image.Pt(1, 1))} {
+					if q := pt.Sub(rect.Min); img.At(q.X, q.Y) != targetimg.At(pt.X, pt.Y) {
+						t.Fatalf("thumb of %s is not the tile at %v", f.Name, pt)
+					}
+				}
+
+				// a click opens the lib pic, on the host where it is, from a LibFS its copy
+				var pic string
+				if libfs == "host" {
+					u, err := url.Parse(f.URL)
+					if err != nil || u.Scheme != "file" {
+						t.Fatalf("url of %s: %s", f.Name, f.URL)
+					}
+					pic = filepath.FromSlash(u.Path)
+				} else {
+					pic = filepath.Join(moved, filepath.FromSlash(f.URL))
+				}
+				data, err := os.ReadFile(pic)
+				if err != nil {
+					t.Fatalf("pic of %s: %s", f.Name, err)
+				}
+				var i int
+				fmt.Sscanf(filepath.Base(f.Name), "%02d.png", &i)
+				if !bytes.Equal(data, test_pic(t, i)) {
+					t.Fatalf("%s links another pic", f.Name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package mosaic
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"math"
+)
+
+// xyzD50ToSRGB turns the D50 XYZ of an ICC profile connection space into linear sRGB (Bradford adapted)
+var xyzD50ToSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// iccTransform converts the pixels of a matrix/TRC RGB profile to sRGB
+type iccTransform struct {
+	linear [3][256]float64 // the TRC of each channel
+	matrix [3][3]float64   // linear profile RGB to linear sRGB
+}
+
+// parse_icc reads a matrix/TRC RGB profile, nil when the profile is some other kind or already sRGB
+func parse_icc(profile []byte) (*iccTransform, error) {
+	if len(profile) < 132 {
+		return nil, errors.New("icc too short")
+	}
+	if string(profile[16:20]) != "RGB " {
+		return nil, nil
+	}
+
+	tags := map[string][]byte{}
+	n := int(binary.BigEndian.Uint32(profile[128:]))
+	for i := 0; i < n; i++ {
+		entry := 132 + i*12
+		if entry+12 > len(profile) {
+			return nil, errors.New("icc bad tag table")
+		}
+		offset := int(binary.BigEndian.Uint32(profile[entry+4:]))
+		size := int(binary.BigEndian.Uint32(profile[entry+8:]))
+		if offset < 0 || size < 0 || offset+size > len(profile) {
+			return nil, errors.New("icc bad tag")
+		}
+		tags[string(profile[entry:entry+4])] = profile[offset : offset+size]
+	}
+
+	t := &iccTransform{}
+	var m [3][3]float64
+	for c, name := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		tag, ok := tags[name]
+		if !ok {
+			return nil, nil
+		}
+		if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+			return nil, errors.New("icc bad " + name)
+		}
+		for k := 0; k < 3; k++ {
+			m[k][c] = s15fixed16(tag[8+k*4:])
+		}
+	}
+	for c, name := range []string{"rTRC", "gTRC", "bTRC"} {
+		tag, ok := tags[name]
+		if !ok {
+			return nil, nil
+		}
+		curve, err := parse_trc(tag)
+		if err != nil {
+			return nil, err
+		}
+		for v := 0; v < 256; v++ {
+			t.linear[c][v] = curve(float64(v) / 255)
+		}
+	}
+
+	srgb := true
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				t.matrix[i][j] += xyzD50ToSRGB[i][k] * m[k][j]
+			}
+			want := 0.0
+			if i == j {
+				want = 1
+			}
+			if math.Abs(t.matrix[i][j]-want) > 0.02 {
+				srgb = false
+			}
+		}
+	}
+	for c := 0; c < 3 && srgb; c++ {
+		for v := 0; v < 256; v++ {
+			if math.Abs(srgb_encode(t.linear[c][v])-float64(v)/255) > 1.0/255 {
+				srgb = false
+				break
+			}
+		}
+	}
+	if srgb {
+		return nil, nil
+	}
+
+	return t, nil
+}
+
+// parse_trc reads a curv or para tone curve
+func parse_trc(tag []byte) (func(float64) float64, error) {
+	if len(tag) < 12 {
+		return nil, errors.New("icc bad trc")
+	}
+
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if n == 0 {
+			return func(x float64) float64 { return x }, nil
+		}
+		if len(tag) < 12+n*2 {
+			return nil, errors.New("icc bad curv")
+		}
+		if n == 1 {
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+i*2:])) / 65535
+		}
+		return func(x float64) float64 {
+			pos := x * float64(n-1)
+			i := int(pos)
+			if i >= n-1 {
+				return table[n-1]
+			}
+			f := pos - float64(i)
+			return table[i]*(1-f) + table[i+1]*f
+		}, nil
+	case "para":
+		typ := int(binary.BigEndian.Uint16(tag[8:]))
+		counts := []int{1, 3, 4, 5, 7}
+		if typ >= len(counts) || len(tag) < 12+counts[typ]*4 {
+			return nil, errors.New("icc bad para")
+		}
+		var p [7]float64
+		for i := 0; i < counts[typ]; i++ {
+			p[i] = s15fixed16(tag[12+i*4:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		pow := func(x float64) float64 { return math.Pow(math.Max(x, 0), g) }
+		return func(x float64) float64 {
+			switch typ {
+			case 1:
+				if x >= -b/a {
+					return pow(a*x + b)
+				}
+				return 0
+			case 2:
+				if x >= -b/a {
+					return pow(a*x+b) + c
+				}
+				return c
+			case 3:
+				if x >= d {
+					return pow(a*x + b)
+				}
+				return c * x
+			case 4:
+				if x >= d {
+					return pow(a*x+b) + e
+				}
+				return c*x + f
+			}
+			return pow(x)
+		}, nil
+	}
+	return nil, errors.New("icc unknown trc " + string(tag[:4]))
+}
+
+// to_srgb returns img converted from the profile to sRGB
+func (t *iccTransform) to_srgb(img image.Image) image.Image {
+	var encode [4096]uint8
+	for i := range encode {
+		encode[i] = clamp_uint8(srgb_encode(float64(i)/float64(len(encode)-1)) * 255)
+	}
+
+	dst := to_rgba(img, img.Bounds())
+	if dst == img {
+		dst = image.NewRGBA(dst.Bounds())
+		copy(dst.Pix, img.(*image.RGBA).Pix)
+	}
+
+	for i := 0; i+4 <= len(dst.Pix); i += 4 {
+		a := dst.Pix[i+3]
+		if a == 0 {
+			continue
+		}
+		var in [3]uint8
+		for c := 0; c < 3; c++ {
+			// RGBA is alpha premultiplied
+			in[c] = uint8(minInt(int(dst.Pix[i+c])*255/int(a), 255))
+		}
+		lin := [3]float64{t.linear[0][in[0]], t.linear[1][in[1]], t.linear[2][in[2]]}
+		for c := 0; c < 3; c++ {
+			v := t.matrix[c][0]*lin[0] + t.matrix[c][1]*lin[1] + t.matrix[c][2]*lin[2]
+			v = math.Max(0, math.Min(1, v))
+			dst.Pix[i+c] = uint8(int(encode[int(v*float64(len(encode)-1)+0.5)]) * int(a) / 255)
+		}
+	}
+	return dst
+}
+
+func srgb_encode(v float64) float64 {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+func s15fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
@@ -0,0 +1,39 @@
+package mosaic
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// hostFS is the host filesystem taking names as os.Open does, so lib pics on it keep their absolute paths as keys
+type hostFS struct{}
+
+func (hostFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+func (hostFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (hostFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+// lib_fs returns the filesystem of the lib and the dir of the lib in it, LibFS with Lib as the dir,
+// or the host filesystem with Lib made absolute, either one with its archives opened as folders
+func lib_fs(req *Request) (*archiveFS, string, error) {
+	if req.LibFS != nil {
+		if req.Lib == "" {
+			return new_archive_fs(req.LibFS), ".", nil
+		}
+		return new_archive_fs(req.LibFS), req.Lib, nil
+	}
+
+	lib, err := filepath.Abs(req.Lib)
+	if err != nil {
+		return nil, "", err
+	}
+	return new_archive_fs(hostFS{}), lib, nil
+}
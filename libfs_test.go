@@ -0,0 +1,82 @@
+package mosaic
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"path/filepath"
+	"sort"
+	"testing"
+	"testing/fstest"
+
+	"github.com/chyroc/go-ptr"
+	bolt "go.etcd.io/bbolt"
+)
+
+// lib_filenames returns the sorted names of the pics indexed in database for req
+func lib_filenames(t *testing.T, req *Request) []string {
+	db, err := bolt.Open(*req.Database, 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	bucket_name, _ := get_bucket_name(*req.LibName, TileOption{Width: *req.TileWidth, Height: *req.TileHeight, Crop: *req.Crop, Fit: *req.Fit})
+	fis, err := load_fileinfos(db, bucket_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		names = append(names, fi.Filename)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestIndexLibFS(t *testing.T) {
+	lib := fstest.MapFS{
+		"photos/notes.txt":  {Data: []byte("no pic")},
+		"photos/broken.png": {Data: []byte("\x89PNG\r\n\x1a\nbroken")},
+		"other/skipped.png": {Data: test_pic(t, 9)},
+	}
+	var want []string
+	for i := 0; i < 6; i++ {
+		name := fmt.Sprintf("photos/%d.png", i)
+		if i >= 3 {
+			name = fmt.Sprintf("photos/sub/%d.png", i)
+		}
+		lib[name] = &fstest.MapFile{Data: test_pic(t, i)}
+		want = append(want, name)
+	}
+	sort.Strings(want)
+
+	req := &Request{LibFS: lib, Lib: "photos", Database: ptr.String(filepath.Join(t.TempDir(), "database.bin")), PixelSize: ptr.Int(8), Worker: ptr.Int(4)}
+	if err := Index(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	got := lib_filenames(t, req)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("indexed %v want %v", got, want)
+	}
+
+	// the second run finds all of them in the database, and a removed pic is dropped
+	delete(lib, "photos/sub/5.png")
+	if err := Index(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if got := lib_filenames(t, req); fmt.Sprint(got) != fmt.Sprint(want[:len(want)-1]) {
+		t.Fatalf("second run indexed %v", got)
+	}
+
+	req.SrcImage = test_src(6, 4)
+	req.Seed = ptr.Int64(1)
+	img, err := MosaicImage(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Size() != image.Pt(6*8, 4*8) {
+		t.Fatalf("target size %v", img.Bounds().Size())
+	}
+}
@@ -0,0 +1,276 @@
+package mosaic
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Manifest records which lib pic went where in a target, and how the target was laid out
+type Manifest struct {
+	Width      int    `json:"width"`       // target width in pixels
+	Height     int    `json:"height"`      // target height in pixels
+	Columns    int    `json:"columns"`     // src pixels across, the cell grid
+	Rows       int    `json:"rows"`        // src pixels down
+	TileWidth  int    `json:"tile_width"`  // tile width in pixels
+	TileHeight int    `json:"tile_height"` // tile height in pixels
+	Layout     string `json:"layout"`
+	Background string `json:"background"` // background color of the Circle layout, #rrggbb
+	Crop       string `json:"crop"`
+	Fit        string `json:"fit"`
+	LibName    string `json:"lib_name"`
+	Seed       int64  `json:"seed"`
+
+	Placements []Placement `json:"placements"`
+}
+
+// Placement is the lib pic drawn in one cell
+type Placement struct {
+	X         int             `json:"x"`         // cell column, see Cell
+	Y         int             `json:"y"`         // cell row
+	Size      int             `json:"size"`      // cell size in src pixels
+	Rect      image.Rectangle `json:"rect"`      // where the pic is in the target
+	Filename  string          `json:"filename"`  // key of the pic in the lib
+	Hash      string          `json:"hash"`      // xxhash of the pic file
+	Distance  float64         `json:"distance"`  // color distance of the pic from the cell
+	Transform string          `json:"transform"` // flip or rotation the pic is drawn with
+}
+
+var manifestHeader = []string{"x", "y", "size", "left", "top", "right", "bottom", "filename", "hash", "distance", "transform"}
+
+// manifest_format returns the format of the manifest path by its extension, "" when it is not supported
+func manifest_format(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return "json"
+	case ".csv":
+		return "csv"
+	}
+	return ""
+}
+
+// write_manifest writes the manifest as json, or as csv with the placements only
+func write_manifest(path string, manifest *Manifest) error {
+	file, err := os.Create(path)
+	if err != nil {
+		log.Printf("write_manifest create file fail %s %s", path, err)
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	switch manifest_format(path) {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(manifest)
+	case "csv":
+		err = encode_manifest_csv(w, manifest)
+	default:
+		err = errors.New("manifest format not supported")
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		log.Printf("write_manifest fail %s %s", path, err)
+		return err
+	}
+
+	log.Printf("write_manifest ok %s %d", path, len(manifest.Placements))
+	return nil
+}
+
+func encode_manifest_csv(w *bufio.Writer, manifest *Manifest) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(manifestHeader); err != nil {
+		return err
+	}
+	for _, p := range manifest.Placements {
+		record := []string{
+			strconv.Itoa(p.X), strconv.Itoa(p.Y), strconv.Itoa(p.Size),
+			strconv.Itoa(p.Rect.Min.X), strconv.Itoa(p.Rect.Min.Y), strconv.Itoa(p.Rect.Max.X), strconv.Itoa(p.Rect.Max.Y),
+			p.Filename, p.Hash, strconv.FormatFloat(p.Distance, 'f', 2, 64), p.Transform,
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// read_manifest reads a manifest written by write_manifest, one read from csv only has placements
+func read_manifest(path string) (*Manifest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("read_manifest Open fail %s %s", path, err)
+		return nil, err
+	}
+	defer file.Close()
+
+	manifest := &Manifest{}
+	switch manifest_format(path) {
+	case "json":
+		err = json.NewDecoder(bufio.NewReader(file)).Decode(manifest)
+	case "csv":
+		manifest.Placements, err = decode_manifest_csv(bufio.NewReader(file))
+	default:
+		err = errors.New("manifest format not supported")
+	}
+	if err != nil {
+		log.Printf("read_manifest fail %s %s", path, err)
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func decode_manifest_csv(r io.Reader) ([]Placement, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) <= 0 || strings.Join(records[0], ",") != strings.Join(manifestHeader, ",") {
+		return nil, errors.New("csv header error")
+	}
+
+	placements := make([]Placement, 0, len(records)-1)
+	for i, record := range records[1:] {
+		var ints [7]int
+		for j := range ints {
+			ints[j], err = strconv.Atoi(record[j])
+			if err != nil {
+				return nil, fmt.Errorf("csv line %d: %s", i+2, err)
+			}
+		}
+		distance, err := strconv.ParseFloat(record[9], 64)
+		if err != nil {
+			return nil, fmt.Errorf("csv line %d: %s", i+2, err)
+		}
+		placements = append(placements, Placement{X: ints[0], Y: ints[1], Size: ints[2], Rect: image.Rect(ints[3], ints[4], ints[5], ints[6]),
+			Filename: record[7], Hash: record[8], Distance: distance, Transform: record[10]})
+	}
+	return placements, nil
+}
+
+// render_manifest draws the placements of the manifest FromManifest again at the tile size of req,
+// every tile is scaled from its lib original, a csv manifest takes the layout, crop and fit of req
+func render_manifest(ctx context.Context, req *Request, libfs fs.FS, background color.RGBA, format string) (*image.RGBA, *Manifest, error) {
+	log.Printf("render_manifest %s target %s", *req.FromManifest, req.Target)
+
+	manifest, err := read_manifest(*req.FromManifest)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(manifest.Placements) <= 0 {
+		return nil, nil, errors.New("no placement")
+	}
+
+	if manifest.Layout == "" {
+		manifest.Layout = *req.Layout
+		manifest.Background = *req.Background
+		manifest.Crop = *req.Crop
+		manifest.Fit = *req.Fit
+		manifest.LibName = *req.LibName
+		manifest.Seed = *req.Seed
+	}
+	if manifest.Background != *req.Background {
+		background, err = parse_color(manifest.Background)
+		if err != nil {
+			return nil, nil, fmt.Errorf("manifest background color error, #rrggbb")
+		}
+	}
+	if !isLayout(manifest.Layout) || !isCrop(manifest.Crop) || !isFit(manifest.Fit) {
+		return nil, nil, fmt.Errorf("manifest layout crop fit error")
+	}
+	if manifest.Columns <= 0 || manifest.Rows <= 0 {
+		for _, p := range manifest.Placements {
+			manifest.Columns = maxInt(manifest.Columns, p.X+p.Size)
+			manifest.Rows = maxInt(manifest.Rows, p.Y+p.Size)
+		}
+		if manifest.Layout == "Hex" {
+			// hex rows are 3/4 of a tile apart
+			manifest.Rows = manifest.Rows * 3 / 4
+		}
+	}
+
+	tilew := *req.TileWidth
+	tileh := *req.TileHeight
+	opt := TileOption{Width: tilew, Height: tileh, Scaler: getScaler(*req.Scalealg), Crop: manifest.Crop, Fit: manifest.Fit, Upscale: true}
+
+	db, err := bolt.Open(*req.Database, 0o600, nil)
+	if err != nil {
+		log.Printf("render_manifest Open database fail %s %s", *req.Database, err)
+		return nil, nil, err
+	}
+	defer db.Close()
+
+	// the crop boxes found when the lib was indexed at the tile size of the manifest still fit tiles of the same shape
+	crops := make(map[string]FileInfo)
+	if manifest.TileWidth*tileh == manifest.TileHeight*tilew {
+		bucket_name, _ := get_bucket_name(manifest.LibName, TileOption{Width: manifest.TileWidth, Height: manifest.TileHeight, Crop: manifest.Crop, Fit: manifest.Fit})
+		fis, err := load_fileinfos(db, bucket_name)
+		if err != nil {
+			log.Printf("render_manifest load_fileinfos fail %s %s", bucket_name, err)
+			return nil, nil, err
+		}
+		for _, fi := range fis {
+			crops[fi.Filename] = fi
+		}
+	}
+	_, tile_bucket_name := get_bucket_name(manifest.LibName, opt)
+
+	cells := make([]Cell, 0, len(manifest.Placements))
+	for _, p := range manifest.Placements {
+		transform, ok := get_transform(p.Transform)
+		if !ok {
+			return nil, nil, fmt.Errorf("manifest transform error %s", p.Transform)
+		}
+		fi := FileInfo{Filename: p.Filename, Hash: p.Hash}
+		if cfi, ok := crops[p.Filename]; ok {
+			if cfi.Hash != p.Hash {
+				log.Printf("render_manifest pic changed since the manifest %s %s %s", p.Filename, cfi.Hash, p.Hash)
+			}
+			fi.Crop = cfi.Crop
+		}
+
+		cell := Cell{X: p.X, Y: p.Y, Size: maxInt(p.Size, 1)}
+		cell.Rect = cell_rect(manifest.Layout, cell, tilew, tileh)
+		cell.Match = &Match{FileInfo: fi, Transform: transform}
+		cells = append(cells, cell)
+	}
+
+	masks := NewMaskCache(manifest.Layout, tilew, tileh)
+	size := image.Point{manifest.Columns * tilew, manifest.Rows * tileh}
+	img, placements, err := draw_target(ctx, req.Target, cells, masks, size, libfs, db, nil, tile_bucket_name, opt, nil, manifest.Seed, NewMatchCache(),
+		*req.Worker, *req.MaxSize, *req.CacheSize, background, format, req.Progress, req.TileStat)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the cells have no src colors, the distances are the ones the tiles were matched with
+	for i := range placements {
+		placements[i].Distance = manifest.Placements[i].Distance
+	}
+
+	manifest.Width = size.X
+	manifest.Height = size.Y
+	manifest.TileWidth = tilew
+	manifest.TileHeight = tileh
+	manifest.Placements = placements
+	return img, manifest, nil
+}
@@ -0,0 +1,147 @@
+package mosaic
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics of all the indexing and rendering done by this process, MetricsHandler serves them
+var (
+	metricIndexed       = &counter{name: "mosaic_images_indexed_total", help: "Lib pics added to the database."}
+	metricIndexFailures = &counter{name: "mosaic_index_failures_total", help: "Lib pics that could not be indexed."}
+	metricUnsupported   = &counter{name: "mosaic_unsupported_files_total", help: "Lib files that are no pic or archive."}
+	metricDecodeFailure = &counter{name: "mosaic_decode_failures_total", help: "Pics that could not be decoded."}
+	metricBytesRead     = &counter{name: "mosaic_lib_bytes_read_total", help: "Bytes read from lib files."}
+	metricTilesPlaced   = &counter{name: "mosaic_tiles_placed_total", help: "Tiles drawn into targets."}
+	metricTileHits      = &counter{name: "mosaic_tile_cache_hits_total", help: "Tiles found in the tile cache."}
+	metricTileMisses    = &counter{name: "mosaic_tile_cache_misses_total", help: "Tiles loaded from the database or the lib."}
+
+	metricPhase = &histogram{name: "mosaic_phase_duration_seconds", help: "Time spent in each phase, check/scan/index of the lib, draw/write of the target.",
+		buckets: []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}}
+
+	metricCounters = []*counter{metricIndexed, metricIndexFailures, metricUnsupported, metricDecodeFailure, metricBytesRead,
+		metricTilesPlaced, metricTileHits, metricTileMisses}
+)
+
+type counter struct {
+	name  string
+	help  string
+	value int64
+}
+
+func (c *counter) Add(n int64) {
+	atomic.AddInt64(&c.value, n)
+}
+
+func (c *counter) Get() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+// histogram has one series per value of its phase label
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	lock   sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) Observe(phase string, d time.Duration) {
+	v := d.Seconds()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.series == nil {
+		h.series = make(map[string]*histogramSeries)
+	}
+	s, ok := h.series[phase]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[phase] = s
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	phases := make([]string, 0, len(h.series))
+	for phase := range h.series {
+		phases = append(phases, phase)
+	}
+	sort.Strings(phases)
+	for _, phase := range phases {
+		s := h.series[phase]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket{phase=%q,le=%q} %d\n", h.name, phase, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{phase=%q,le=\"+Inf\"} %d\n", h.name, phase, s.count)
+		fmt.Fprintf(w, "%s_sum{phase=%q} %s\n", h.name, phase, strconv.FormatFloat(s.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{phase=%q} %d\n", h.name, phase, s.count)
+	}
+}
+
+// write_metrics writes the metrics in the Prometheus text format
+func write_metrics(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, c := range metricCounters {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.Get())
+	}
+
+	hits := float64(metricTileHits.Get())
+	ratio := hits / (hits + float64(metricTileMisses.Get()))
+	if math.IsNaN(ratio) {
+		ratio = 0
+	}
+	fmt.Fprintf(bw, "# HELP mosaic_tile_cache_hit_ratio Share of tiles found in the tile cache.\n# TYPE mosaic_tile_cache_hit_ratio gauge\n")
+	fmt.Fprintf(bw, "mosaic_tile_cache_hit_ratio %s\n", strconv.FormatFloat(ratio, 'g', -1, 64))
+
+	metricPhase.write(bw)
+	return bw.Flush()
+}
+
+// MetricsHandler serves the metrics of the indexing and rendering done by this process in the Prometheus text format
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		write_metrics(w)
+	})
+}
+
+// countFile counts the bytes read from a lib file
+type countFile struct {
+	fs.File
+}
+
+func (f countFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	metricBytesRead.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,111 @@
+package mosaic
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogramWrite(t *testing.T) {
+	h := &histogram{name: "test_seconds", help: "Test time.", buckets: []float64{0.1, 1, 10}}
+	for _, d := range []time.Duration{62500 * time.Microsecond, 500 * time.Millisecond, 500 * time.Millisecond, 20 * time.Second} {
+		h.Observe("b", d)
+	}
+	h.Observe("a", 10*time.Second)
+
+	var b bytes.Buffer
+	h.write(&b)
+	// the phases are sorted, the buckets count every value up to le
+	want := `# HELP test_seconds Test time.
+# TYPE test_seconds histogram
+test_seconds_bucket{phase="a",le="0.1"} 0
+test_seconds_bucket{phase="a",le="1"} 0
+test_seconds_bucket{phase="a",le="10"} 1
+test_seconds_bucket{phase="a",le="+Inf"} 1
+test_seconds_sum{phase="a"} 10
+test_seconds_count{phase="a"} 1
+test_seconds_bucket{phase="b",le="0.1"} 1
+test_seconds_bucket{phase="b",le="1"} 3
+test_seconds_bucket{phase="b",le="10"} 3
+test_seconds_bucket{phase="b",le="+Inf"} 4
+test_seconds_sum{phase="b"} 21.0625
+test_seconds_count{phase="b"} 4
+`
+	if b.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	indexed := metricIndexed.Get()
+	metricIndexed.Add(3)
+	metricPhase.Observe("test", 2*time.Second)
+
+	rec := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("content type %s", ct)
+	}
+	text := rec.Body.String()
+
+	for _, want := range []string{
+		"# HELP mosaic_images_indexed_total Lib pics added to the database.\n# TYPE mosaic_images_indexed_total counter\nmosaic_images_indexed_total " + strconv.FormatInt(indexed+3, 10) + "\n",
+		"# TYPE mosaic_tile_cache_hit_ratio gauge\n",
+		"# TYPE mosaic_phase_duration_seconds histogram\n",
+		"mosaic_phase_duration_seconds_bucket{phase=\"test\",le=\"1\"} 0\n",
+		"mosaic_phase_duration_seconds_bucket{phase=\"test\",le=\"5\"} 1\n",
+		"mosaic_phase_duration_seconds_bucket{phase=\"test\",le=\"+Inf\"} 1\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("no %q in\n%s", want, text)
+		}
+	}
+
+	// every sample is name{labels} value, every counter has HELP and TYPE, buckets only grow up to +Inf, which is the count
+	line := regexp.MustCompile(`^([a-z_]+)(\{phase="([a-z]+)"(,le="([^"]+)")?\})? (\S+)$`)
+	types := map[string]string{}
+	last := map[string]float64{}
+	for _, l := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		if strings.HasPrefix(l, "# TYPE ") {
+			f := strings.Fields(l)
+			types[f[2]] = f[3]
+			continue
+		}
+		if strings.HasPrefix(l, "# HELP ") {
+			continue
+		}
+		m := line.FindStringSubmatch(l)
+		if m == nil {
+			t.Fatalf("bad line %q", l)
+		}
+		v, err := strconv.ParseFloat(m[6], 64)
+		if err != nil {
+			t.Fatalf("bad value %q", l)
+		}
+		name, phase, le := m[1], m[3], m[5]
+		switch {
+		case strings.HasSuffix(name, "_bucket"):
+			if types[strings.TrimSuffix(name, "_bucket")] != "histogram" || v < last[phase] {
+				t.Fatalf("bucket %q", l)
+			}
+			last[phase] = v
+			if le == "+Inf" {
+				last[phase+" inf"] = v
+			}
+		case strings.HasSuffix(name, "_count"):
+			if v != last[phase+" inf"] {
+				t.Fatalf("count %q of +Inf %v", l, last[phase+" inf"])
+			}
+			last[phase] = 0
+		case strings.HasSuffix(name, "_sum"):
+		default:
+			if types[name] == "" {
+				t.Fatalf("no TYPE for %q", l)
+			}
+		}
+	}
+}
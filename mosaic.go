@@ -2,49 +2,315 @@ package mosaic
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	_ "image/gif"
-	"image/jpeg"
 	_ "image/jpeg"
 	"image/png"
 	_ "image/png"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
 	"math"
-	"math/rand"
 	"os"
-	"path/filepath"
 	"strconv"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/OneOfOne/xxhash"
-	"github.com/boltdb/bolt"
 	"github.com/chyroc/go-ptr"
+	bolt "go.etcd.io/bbolt"
 	"golang.org/x/image/draw"
 )
 
 type Request struct {
-	Src       string  // src image path
-	Target    string  // target image path
-	Lib       string  // image lib path
-	Worker    *int    // worker thread num
-	Database  *string // cache datbase
-	PixelSize *int    // pic scale size per one pixel
-	Scalealg  *string // pic scale function NearestNeighbor/ApproxBiLinear/BiLinear/CatmullRom
-	CheckHash *bool   //
-	MaxSize   *int    // pic max size in GB
-	LibName   *string //  image lib name in database
-	SrcSize   *int    // src image auto scale pixel size
+	Src        string      // src image path
+	SrcImage   image.Image // src image, used instead of Src
+	SrcReader  io.Reader   // src image stream, used instead of Src
+	Target     string      // target image path
+	Lib        string      // image lib path, zip, tar and tar.gz files in it are read as folders
+	LibFS      fs.FS       // filesystem of the lib, Lib is the dir in it, default the host filesystem
+	Worker     *int        // worker thread num
+	Database   *string     // cache datbase
+	PixelSize  *int        // pic scale size per one pixel
+	TileWidth  *int        // tile width, default PixelSize
+	TileHeight *int        // tile height, default PixelSize
+	Scalealg   *string     // pic scale function NearestNeighbor/ApproxBiLinear/BiLinear/CatmullRom/Area
+	Crop       *string     // lib pic crop function Center/Entropy/Edge/Skin
+	Fit        *string     // lib pic fit function Crop/Pad/Blur, Pad and Blur keep the whole pic
+	CheckHash  *bool       //
+	MaxSize    *int        // pic max size in GB
+	LibName    *string     //  image lib name in database
+	SrcSize    *int        // src image auto scale pixel size
+	Columns    *int        // tiles across, with Rows overrides SrcSize, 0 follows the src aspect
+	Rows       *int        // tiles down, with Columns overrides SrcSize, 0 follows the src aspect
+	Sharpen    *float64    // unsharp mask amount applied to the scaled src, 0 disables
+	Contrast   *float64    // contrast factor applied to the scaled src, 1 keeps it
+	CacheSize  *int        // tile image cache size in MB
+	Quadtree   *int        // max tile size in src pixels, a power of 2, big tiles go where the src is flat, 1 disables
+	QuadLimit  *float64    // max color deviation of a src block to use one big tile
+	Layout     *string     // cell layout Square/Brick/Hex/Circle
+	Background *string     // background color of the Circle layout, #rrggbb
+	Transform  *string     // tile transforms tried when matching None/Flip/All, Flip mirrors left to right, All also flips upside down and rotates square tiles
+	Seed       *int64      // seed of the random tile choice, the same seed renders the same target, default random, recorded in png, jpg, tiff and webp targets
+	Dither     *bool       // spread the color error of each cell to the cells right and below it (Floyd-Steinberg)
+
+	Weight       *string           // grayscale weight mask stretched over src, brighter cells get the best and least reused tiles first
+	WeightRects  []image.Rectangle // rects of src in src pixels with full weight, the rest has none unless Weight says so
+	ReusePenalty *float64          // color distance added to a tile per avg number of uses when Weight or WeightRects is set
+
+	JpegQuality    *int    // jpg target quality 1-100
+	PngCompression *string // png target compression Default/None/BestSpeed/BestCompression
+	Progressive    *bool   // Adam7 interlaced png target, shown coarse first while loading, image/jpeg only writes baseline jpg so a progressive jpg target is an error
+
+	Manifest     *string // placement manifest path written with the target, .json or .csv, "" writes none
+	FromManifest *string // placement manifest to render again at the tile size of req from the lib originals, Src is not used and nothing is matched
+	HTML         *string // html page path written with the target, shows a tile on hover and opens its lib pic on click, move it with the target and its _files dir
+
+	Progress func(stage string, done int, total int) // called about once a second while indexing ("index") and drawing ("draw"), and when each is done
+	TileStat func(stat TileCacheStat)                // called with the tile cache hits and misses whenever Progress is called while drawing
 }
 
 func Mosaic(req *Request) error {
+	return MosaicContext(context.Background(), req)
+}
+
+// MosaicContext is Mosaic that stops loading and generating once ctx is done
+func MosaicContext(ctx context.Context, req *Request) error {
+	format := target_format(req.Target)
+	if format == "" {
+		return fmt.Errorf("target type error, png/jpg/jpeg/tif/tiff/bmp/webp")
+	}
+
+	img, enc, err := mosaic_image(ctx, req, format)
+	if err != nil {
+		return err
+	}
+	return write_target(req.Target, img, format, enc)
+}
+
+// MosaicImage is MosaicContext that returns the target instead of writing it, Target is not used
+func MosaicImage(ctx context.Context, req *Request) (image.Image, error) {
+	img, _, err := mosaic_image(ctx, req, "")
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// MosaicWriter is MosaicContext that encodes the target into w as format png/jpeg/tiff/bmp/webp, Target is not used
+func MosaicWriter(ctx context.Context, req *Request, w io.Writer, format string) error {
+	if !isFormat(format) {
+		return fmt.Errorf("format type error, png/jpeg/tiff/bmp/webp")
+	}
+
+	img, enc, err := mosaic_image(ctx, req, format)
+	if err != nil {
+		return err
+	}
+	return encode_target(w, img, format, enc)
+}
+
+// Index adds the pics of the lib of req to its database at the tile size of req and renders nothing,
+// so the next Mosaic with the same lib and tile size only checks the database
+func Index(ctx context.Context, req *Request) error {
+	set_defaults(req)
+
+	if *req.TileWidth <= 0 || *req.TileHeight <= 0 {
+		return fmt.Errorf("tile size error")
+	}
+
+	if getScaler(*req.Scalealg) == nil {
+		return fmt.Errorf("scalealg type error")
+	}
+
+	if !isCrop(*req.Crop) {
+		return fmt.Errorf("crop type error")
+	}
+
+	if !isFit(*req.Fit) {
+		return fmt.Errorf("fit type error")
+	}
+
+	libfs, lib, err := lib_fs(req)
+	if err != nil {
+		return err
+	}
+	defer libfs.Close()
+
+	opt := TileOption{Width: *req.TileWidth, Height: *req.TileHeight, Scaler: getScaler(*req.Scalealg), Crop: *req.Crop, Fit: *req.Fit}
+	return load_lib(ctx, libfs, lib, *req.Worker, *req.Database, opt, *req.CheckHash, *req.LibName, req.Progress)
+}
+
+// mosaic_image makes the target of req, format is what it will be encoded as, "" when it is not
+func mosaic_image(ctx context.Context, req *Request, format string) (*image.RGBA, EncodeOption, error) {
+	set_defaults(req)
+
+	if *req.TileWidth <= 0 || *req.TileHeight <= 0 {
+		return nil, EncodeOption{}, fmt.Errorf("tile size error")
+	}
+
+	if *req.Columns < 0 || *req.Rows < 0 {
+		return nil, EncodeOption{}, fmt.Errorf("columns rows error")
+	}
+
+	if *req.Sharpen < 0 || *req.Contrast <= 0 {
+		return nil, EncodeOption{}, fmt.Errorf("sharpen contrast error")
+	}
+
+	if *req.ReusePenalty < 0 {
+		return nil, EncodeOption{}, fmt.Errorf("reuse penalty error")
+	}
+
+	if *req.Dither && (*req.Weight != "" || len(req.WeightRects) > 0) {
+		return nil, EncodeOption{}, fmt.Errorf("dither can not be used with weight")
+	}
+
+	if *req.Quadtree <= 0 || *req.Quadtree&(*req.Quadtree-1) != 0 {
+		return nil, EncodeOption{}, fmt.Errorf("quadtree size error, power of 2")
+	}
+
+	if !isLayout(*req.Layout) {
+		return nil, EncodeOption{}, fmt.Errorf("layout type error")
+	}
+
+	if !isTransform(*req.Transform) {
+		return nil, EncodeOption{}, fmt.Errorf("transform type error")
+	}
+
+	if *req.Quadtree > 1 && *req.Layout != "Square" {
+		return nil, EncodeOption{}, fmt.Errorf("quadtree needs Square layout")
+	}
+
+	background, err := parse_color(*req.Background)
+	if err != nil {
+		return nil, EncodeOption{}, fmt.Errorf("background color error, #rrggbb")
+	}
+
+	if getScaler(*req.Scalealg) == nil {
+		return nil, EncodeOption{}, fmt.Errorf("scalealg type error")
+	}
+
+	if !isCrop(*req.Crop) {
+		return nil, EncodeOption{}, fmt.Errorf("crop type error")
+	}
+
+	if !isFit(*req.Fit) {
+		return nil, EncodeOption{}, fmt.Errorf("fit type error")
+	}
+
+	if *req.JpegQuality < 1 || *req.JpegQuality > 100 {
+		return nil, EncodeOption{}, fmt.Errorf("jpeg quality error, 1-100")
+	}
+
+	pngcompression, ok := getPngCompression(*req.PngCompression)
+	if !ok {
+		return nil, EncodeOption{}, fmt.Errorf("png compression type error")
+	}
+
+	if *req.Progressive && format == "jpeg" {
+		return nil, EncodeOption{}, errProgressiveJpeg
+	}
+
+	if *req.Manifest != "" && manifest_format(*req.Manifest) == "" {
+		return nil, EncodeOption{}, fmt.Errorf("manifest format error, .json or .csv")
+	}
+
+	if *req.FromManifest != "" && manifest_format(*req.FromManifest) == "" {
+		return nil, EncodeOption{}, fmt.Errorf("from manifest format error, .json or .csv")
+	}
+
+	if *req.HTML != "" && req.Target == "" {
+		return nil, EncodeOption{}, fmt.Errorf("html needs a target file")
+	}
+
+	libfs, lib, err := lib_fs(req)
+	if err != nil {
+		return nil, EncodeOption{}, err
+	}
+	defer libfs.Close()
+
+	var img *image.RGBA
+	var manifest *Manifest
+	if *req.FromManifest != "" {
+		img, manifest, err = render_manifest(ctx, req, libfs, background, format)
+	} else {
+		img, manifest, err = match_target(ctx, req, libfs, lib, background, format)
+	}
+	if err != nil {
+		return nil, EncodeOption{}, err
+	}
+
+	if *req.Manifest != "" {
+		err = write_manifest(*req.Manifest, manifest)
+		if err != nil {
+			return nil, EncodeOption{}, err
+		}
+	}
+
+	if *req.HTML != "" {
+		err = write_html(*req.HTML, req.Target, img, manifest, libfs)
+		if err != nil {
+			return nil, EncodeOption{}, err
+		}
+	}
+
+	enc := EncodeOption{JpegQuality: *req.JpegQuality, PngCompression: pngcompression, Progressive: *req.Progressive, Comment: fmt.Sprintf("go-mosaic seed=%d", manifest.Seed)}
+	return img, enc, nil
+}
+
+// match_target renders the src of req with the lib pics that match it best
+func match_target(ctx context.Context, req *Request, libfs *archiveFS, lib string, background color.RGBA, format string) (*image.RGBA, *Manifest, error) {
+	var srcimg, detail image.Image
+
+	log.Printf("start...")
+	log.Printf("src %s", req.Src)
+	log.Printf("target %s", req.Target)
+	log.Printf("lib %s", req.Lib)
+
+	src, err := load_src(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err, srcimg, detail = parse_src(src, req.Src, *req.Scalealg, *req.SrcSize, *req.Columns, *req.Rows, *req.Sharpen, *req.Contrast, *req.TileWidth, *req.TileHeight)
+	if err != nil {
+		return nil, nil, err
+	}
+	opt := TileOption{Width: *req.TileWidth, Height: *req.TileHeight, Scaler: getScaler(*req.Scalealg), Crop: *req.Crop, Fit: *req.Fit}
+
+	err = load_lib(ctx, libfs, lib, *req.Worker, *req.Database, opt, *req.CheckHash, *req.LibName, req.Progress)
+	if err != nil {
+		return nil, nil, err
+	}
+	transforms := get_transforms(*req.Transform, *req.TileWidth == *req.TileHeight)
+
+	weight, err := load_weight(src.Bounds().Size(), *req.Weight, req.WeightRects)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	img, placements, err := gen_target(ctx, srcimg, detail, req.Target, libfs, *req.Worker, *req.Database, opt, *req.MaxSize, *req.LibName, *req.CacheSize, *req.Quadtree, *req.QuadLimit, *req.Layout, background, transforms, *req.Seed, *req.Dither, weight, *req.ReusePenalty, format, req.Progress, req.TileStat)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifest := &Manifest{
+		Width: img.Bounds().Dx(), Height: img.Bounds().Dy(), Columns: srcimg.Bounds().Dx(), Rows: srcimg.Bounds().Dy(),
+		TileWidth: *req.TileWidth, TileHeight: *req.TileHeight, Layout: *req.Layout, Background: *req.Background,
+		Crop: *req.Crop, Fit: *req.Fit, LibName: *req.LibName, Seed: *req.Seed, Placements: placements,
+	}
+	return img, manifest, nil
+}
+
+// set_defaults sets every option of req left nil to its default
+func set_defaults(req *Request) {
 	if req.Worker == nil {
 		req.Worker = ptr.Int(12)
 	}
@@ -54,9 +320,21 @@ func Mosaic(req *Request) error {
 	if req.PixelSize == nil {
 		req.PixelSize = ptr.Int(64)
 	}
+	if req.TileWidth == nil {
+		req.TileWidth = ptr.Int(*req.PixelSize)
+	}
+	if req.TileHeight == nil {
+		req.TileHeight = ptr.Int(*req.PixelSize)
+	}
 	if req.Scalealg == nil {
 		req.Scalealg = ptr.String("CatmullRom")
 	}
+	if req.Crop == nil {
+		req.Crop = ptr.String("Center")
+	}
+	if req.Fit == nil {
+		req.Fit = ptr.String("Crop")
+	}
 	if req.CheckHash == nil {
 		req.CheckHash = ptr.Bool(true)
 	}
@@ -69,133 +347,141 @@ func Mosaic(req *Request) error {
 	if req.SrcSize == nil {
 		req.SrcSize = ptr.Int(128)
 	}
-
-	if getScaler(*req.Scalealg) == nil {
-		return fmt.Errorf("scalealg type error")
+	if req.Columns == nil {
+		req.Columns = ptr.Int(0)
 	}
-
-	if !strings.HasSuffix(strings.ToLower(req.Target), ".png") &&
-		!strings.HasSuffix(strings.ToLower(req.Target), ".jpg") {
-		return fmt.Errorf("target type error, png/jpg")
+	if req.Rows == nil {
+		req.Rows = ptr.Int(0)
 	}
-
-	log.Printf("start...")
-	log.Printf("src %s", req.Src)
-	log.Printf("target %s", req.Target)
-	log.Printf("lib %s", req.Lib)
-
-	err, srcimg, cachemap := parse_src(req.Src, *req.Scalealg, *req.SrcSize)
-	if err != nil {
-		return err
+	if req.Sharpen == nil {
+		req.Sharpen = ptr.Float64(0)
 	}
-	err = load_lib(req.Lib, *req.Worker, *req.Database, *req.PixelSize, *req.Scalealg, *req.CheckHash, *req.LibName)
-	if err != nil {
-		return err
+	if req.Contrast == nil {
+		req.Contrast = ptr.Float64(1)
 	}
-	err = gen_target(srcimg, req.Target, *req.Worker, *req.Database, *req.PixelSize, *req.MaxSize, *req.Scalealg, *req.LibName, cachemap)
-	if err != nil {
-		return err
+	if req.CacheSize == nil {
+		req.CacheSize = ptr.Int(256)
+	}
+	if req.Quadtree == nil {
+		req.Quadtree = ptr.Int(1)
+	}
+	if req.QuadLimit == nil {
+		req.QuadLimit = ptr.Float64(10)
+	}
+	if req.Layout == nil {
+		req.Layout = ptr.String("Square")
+	}
+	if req.Background == nil {
+		req.Background = ptr.String("#000000")
+	}
+	if req.Transform == nil {
+		req.Transform = ptr.String("Flip")
+	}
+	if req.Seed == nil {
+		req.Seed = ptr.Int64(time.Now().UnixNano())
+	}
+	if req.Dither == nil {
+		req.Dither = ptr.Bool(false)
+	}
+	if req.Weight == nil {
+		req.Weight = ptr.String("")
+	}
+	if req.ReusePenalty == nil {
+		req.ReusePenalty = ptr.Float64(8)
+	}
+	if req.JpegQuality == nil {
+		req.JpegQuality = ptr.Int(100)
+	}
+	if req.PngCompression == nil {
+		req.PngCompression = ptr.String("Default")
+	}
+	if req.Progressive == nil {
+		req.Progressive = ptr.Bool(false)
+	}
+	if req.Manifest == nil {
+		req.Manifest = ptr.String("")
+	}
+	if req.FromManifest == nil {
+		req.FromManifest = ptr.String("")
+	}
+	if req.HTML == nil {
+		req.HTML = ptr.String("")
+	}
+	if req.Progress == nil {
+		req.Progress = func(string, int, int) {}
+	}
+	if req.TileStat == nil {
+		req.TileStat = func(TileCacheStat) {}
 	}
-	return nil
-}
-
-type CacheInfo struct {
-	num  int
-	img  []image.Image
-	lock sync.Mutex
 }
 
-func parse_src(src string, scalealg string, srcsize int) (error, image.Image, *sync.Map) {
-	log.Printf("parse_src %s", src)
-
-	reader, err := os.Open(src)
-	if err != nil {
-		log.Printf("parse_src Open fail %s %s", src, err)
-		return err, nil, nil
+// load_src returns the src pic of req, SrcImage, or else decoded from SrcReader, or else from the file Src
+func load_src(req *Request) (image.Image, error) {
+	if req.SrcImage != nil {
+		return req.SrcImage, nil
 	}
-	defer reader.Close()
 
-	fi, err := reader.Stat()
-	if err != nil {
-		log.Printf("parse_src Stat fail %s %s", src, err)
-		return err, nil, nil
+	reader := req.SrcReader
+	if reader == nil {
+		file, err := os.Open(req.Src)
+		if err != nil {
+			log.Printf("load_src Open fail %s %s", req.Src, err)
+			return nil, err
+		}
+		defer file.Close()
+		reader = file
 	}
-	filesize := fi.Size()
 
-	img, _, err := image.Decode(reader)
+	img, _, err := decode_img(reader)
 	if err != nil {
-		log.Printf("parse_src Decode image fail %s %s", src, err)
-		return err, nil, nil
+		log.Printf("load_src Decode image fail %s %s", req.Src, err)
+		return nil, err
 	}
+	return img, nil
+}
+
+// parse_src scales img so that one pixel becomes one tilew*tileh cell and the mosaic keeps the src aspect,
+// or to exactly columns*rows when both are set, detail is img at twice that size for the 2*2 grid of each cell
+func parse_src(img image.Image, src string, scalealg string, srcsize int, columns int, rows int, sharpen float64, contrast float64, tilew int, tileh int) (error, image.Image, image.Image) {
+	log.Printf("parse_src %s", src)
 
 	scale := getScaler(scalealg)
 
 	lenx := img.Bounds().Dx()
 	leny := img.Bounds().Dy()
-	len := maxInt(lenx, leny)
-	if len > srcsize {
-		newlenx := lenx * srcsize / len
-		newleny := leny * srcsize / len
+	len := minInt(maxInt(lenx, leny), srcsize)
+	cellx := lenx * tileh
+	celly := leny * tilew
+	newlenx := maxInt(cellx*len/maxInt(cellx, celly), 1)
+	newleny := maxInt(celly*len/maxInt(cellx, celly), 1)
+	if columns > 0 && rows > 0 {
+		newlenx, newleny = columns, rows
+	} else if columns > 0 {
+		newlenx, newleny = columns, maxInt(columns*celly/cellx, 1)
+	} else if rows > 0 {
+		newlenx, newleny = maxInt(rows*cellx/celly, 1), rows
+	}
+	detailrect := image.Rectangle{image.Point{0, 0}, image.Point{newlenx * 2, newleny * 2}}
+	detail := image.NewRGBA(detailrect)
+	scale.Scale(detail, detailrect, img, img.Bounds(), draw.Over, nil)
+
+	if newlenx != lenx || newleny != leny {
 		rect := image.Rectangle{image.Point{0, 0}, image.Point{newlenx, newleny}}
 		dst := image.NewRGBA(rect)
 		scale.Scale(dst, rect, img, img.Bounds(), draw.Over, nil)
 		img = dst
 	}
 
-	bounds := img.Bounds()
-
-	startx := bounds.Min.X
-	starty := bounds.Min.Y
-	endx := bounds.Max.X
-	endy := bounds.Max.Y
-
-	pixelnum := make(map[string]int)
-	for y := starty; y < endy; y++ {
-		for x := startx; x < endx; x++ {
-			r, g, b, _ := img.At(x, y).RGBA()
-			r, g, b = r>>8, g>>8, b>>8
-
-			pixelnum[make_string(uint8(r), uint8(g), uint8(b))]++
-		}
-	}
-
-	var cachemap sync.Map
-	top := 0
-	num := 0
-	for {
-		maxpixel := ""
-		maxpixelnum := 0
-		for k, v := range pixelnum {
-			if v > maxpixelnum {
-				maxpixelnum = v
-				maxpixel = k
-			}
-		}
-		if maxpixelnum >= 16 {
-			cachemap.Store(maxpixel, &CacheInfo{num: maxpixelnum})
-			num++
-		} else {
-			break
-		}
-		if maxpixelnum > top {
-			top = maxpixelnum
-		}
-		pixelnum[maxpixel] = 0
-	}
-
-	log.Printf("parse_src cache top pixel num=%d max=%d", num, top)
-	for i := 2; i <= top; i++ {
-		cachemap.Range(func(key, value interface{}) bool {
-			ci := value.(*CacheInfo)
-			if ci.num == i {
-				log.Printf("parse_src cache top pixel [%s]=%d", key, i)
-			}
-			return true
-		})
+	if sharpen > 0 || contrast != 1 {
+		dst := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+		draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+		enhance(dst, sharpen, contrast)
+		enhance(detail, sharpen, contrast)
+		img = dst
 	}
 
-	log.Printf("parse_src ok %s %d %d*%d", src, filesize, img.Bounds().Dx(), img.Bounds().Dy())
-	return nil, img, &cachemap
+	log.Printf("parse_src ok %s %d*%d", src, img.Bounds().Dx(), img.Bounds().Dy())
+	return nil, img, detail
 }
 
 func getScaler(scalealg string) draw.Scaler {
@@ -208,6 +494,8 @@ func getScaler(scalealg string) draw.Scaler {
 		scale = draw.BiLinear
 	} else if scalealg == "CatmullRom" {
 		scale = draw.CatmullRom
+	} else if scalealg == "Area" {
+		scale = areaScale
 	}
 	return scale
 }
@@ -218,12 +506,29 @@ type FileInfo struct {
 	G        uint8
 	B        uint8
 	Hash     string
+	Crop     image.Rectangle // part of the pic the tile is scaled from
+	Grid     [4]color.RGBA   // avg color of the top left, top right, bottom left, bottom right of the tile
+	Version  int             // fileInfoVersion the entry was made with
+}
+
+// fileInfoVersion is raised when the way a lib pic is read changes, older entries are made again
+// 1: EXIF orientation and ICC profiles
+const fileInfoVersion = 1
+
+// TileOption says how a lib pic is turned into a tile
+type TileOption struct {
+	Width   int
+	Height  int
+	Scaler  draw.Scaler
+	Crop    string
+	Fit     string
+	Upscale bool // pics smaller than a tile are scaled up instead of failing
 }
 
 type CalFileInfo struct {
 	fi   FileInfo
+	tile []byte
 	ok   bool
-	done bool
 }
 
 type ColorData struct {
@@ -233,7 +538,7 @@ type ColorData struct {
 	b    uint8
 }
 
-func load_lib(lib string, workernum int, database string, pixelsize int, scalealg string, checkhash bool, libname string) error {
+func load_lib(ctx context.Context, libfs *archiveFS, lib string, workernum int, database string, opt TileOption, checkhash bool, libname string, progress func(string, int, int)) error {
 	log.Printf("load_lib %s", lib)
 
 	log.Printf("load_lib start ini database")
@@ -266,14 +571,19 @@ func load_lib(lib string, workernum int, database string, pixelsize int, scaleal
 	}
 	defer db.Close()
 
-	bucket_name := "FileInfo" + libname + strconv.Itoa(pixelsize)
+	bucket_name, tile_bucket_name := get_bucket_name(libname, opt)
 
 	dbtotal := 0
-	db.Update(func(tx *bolt.Tx) error {
+	err = db.Update(func(tx *bolt.Tx) error {
 		_, err := tx.CreateBucketIfNotExists([]byte(bucket_name))
 		if err != nil {
 			log.Printf("load_lib Open database CreateBucketIfNotExists fail %s %s %s", database, bucket_name, err)
-			os.Exit(1)
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte(tile_bucket_name))
+		if err != nil {
+			log.Printf("load_lib Open database CreateBucketIfNotExists fail %s %s %s", database, tile_bucket_name, err)
+			return err
 		}
 		b := tx.Bucket([]byte(bucket_name))
 		b.ForEach(func(k, v []byte) error {
@@ -282,14 +592,15 @@ func load_lib(lib string, workernum int, database string, pixelsize int, scaleal
 		})
 		return nil
 	})
+	if err != nil {
+		return err
+	}
 
-	lastload := time.Now()
 	beginload := time.Now()
 	var doneload int32
-	var loading int32
 	var doneloadsize int64
 	var lock sync.Mutex
-	db.Update(func(tx *bolt.Tx) error {
+	err = db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(bucket_name))
 
 		need_del := make([]string, 0)
@@ -298,9 +609,8 @@ func load_lib(lib string, workernum int, database string, pixelsize int, scaleal
 			k, v []byte
 		}
 
-		tp := NewThreadPool(workernum, 16, func(in interface{}) {
+		tp := NewThreadPool(ctx, workernum, 16, func(ctx context.Context, in interface{}) error {
 			defer atomic.AddInt32(&doneload, 1)
-			defer atomic.AddInt32(&loading, -1)
 
 			lf := in.(LoadFileInfo)
 
@@ -309,38 +619,50 @@ func load_lib(lib string, workernum int, database string, pixelsize int, scaleal
 
 			dec := gob.NewDecoder(&b)
 			var fi FileInfo
-			err = dec.Decode(&fi)
+			err := dec.Decode(&fi)
 			if err != nil {
 				log.Printf("load_lib Open database Decode fail %s %s %s", database, string(lf.k), err)
 				lock.Lock()
 				defer lock.Unlock()
 				need_del = append(need_del, string(lf.k))
-				return
+				return nil
 			}
 
-			osfi, err := os.Stat(fi.Filename)
-			if err != nil && os.IsNotExist(err) {
-				log.Printf("load_lib Open Filename IsNotExist, need delete %s %s %s", database, fi.Filename, err)
+			if fi.Version < fileInfoVersion {
+				log.Printf("load_lib old version need delete %s %s %d", database, fi.Filename, fi.Version)
 				lock.Lock()
 				defer lock.Unlock()
 				need_del = append(need_del, string(lf.k))
-				return
+				return nil
+			}
+
+			osfi, err := fs.Stat(libfs, fi.Filename)
+			if err != nil {
+				if os.IsNotExist(err) {
+					log.Printf("load_lib Open Filename IsNotExist, need delete %s %s %s", database, fi.Filename, err)
+					lock.Lock()
+					defer lock.Unlock()
+					need_del = append(need_del, string(lf.k))
+					return nil
+				}
+				log.Printf("load_lib Stat fail %s %s %s", database, fi.Filename, err)
+				return nil
 			}
 
 			defer atomic.AddInt64(&doneloadsize, osfi.Size())
 
 			if checkhash {
-				reader, err := os.Open(fi.Filename)
+				reader, err := libfs.Open(fi.Filename)
 				if err != nil {
 					log.Printf("load_lib Open fail %s %s %s", database, fi.Filename, err)
-					return
+					return nil
 				}
 				defer reader.Close()
 
 				bytes, err := ioutil.ReadAll(reader)
 				if err != nil {
 					log.Printf("load_lib ReadAll fail %s %s %s", database, fi.Filename, err)
-					return
+					return nil
 				}
 
 				hashstr := GetXXHashString(string(bytes))
@@ -350,133 +672,180 @@ func load_lib(lib string, workernum int, database string, pixelsize int, scaleal
 					lock.Lock()
 					defer lock.Unlock()
 					need_del = append(need_del, string(lf.k))
-					return
+					return nil
 				}
 			}
+			return nil
 		})
 
-		b.ForEach(func(k, v []byte) error {
-			for {
-				ret := tp.AddJobTimeout(int(rand.Int()), LoadFileInfo{k, v}, 10)
-				if ret {
-					atomic.AddInt32(&loading, 1)
-					break
-				}
-			}
-
-			if time.Now().Sub(lastload) >= time.Second {
-				lastload = time.Now()
-				speed := float64(doneload) / float64(int(time.Now().Sub(beginload))/int(time.Second))
-				left := ""
-				if speed > 0 {
-					left = time.Duration(int64(float64(dbtotal-int(doneload))/speed) * int64(time.Second)).String()
-				}
-				donesizem := doneloadsize / 1024 / 1024
-				dataspeed := int(donesizem) / (int(time.Now().Sub(beginload)) / int(time.Second))
-				log.Printf("load speed=%.2f/s percent=%d%% time=%s thead=%d progress=%d/%d data=%dM dataspeed=%dM/s", speed, int(doneload)*100/dbtotal, left,
-					loading, doneload, dbtotal, donesizem, dataspeed)
+		stop := every_second(func() {
+			doneload := atomic.LoadInt32(&doneload)
+			speed := float64(doneload) / float64(int(time.Now().Sub(beginload))/int(time.Second))
+			left := ""
+			if speed > 0 {
+				left = time.Duration(int64(float64(dbtotal-int(doneload))/speed) * int64(time.Second)).String()
 			}
-
-			return nil
+			donesizem := atomic.LoadInt64(&doneloadsize) / 1024 / 1024
+			dataspeed := int(donesizem) / (int(time.Now().Sub(beginload)) / int(time.Second))
+			log.Printf("load speed=%.2f/s percent=%d%% time=%s thead=%d progress=%d/%d data=%dM dataspeed=%dM/s", speed, int(doneload)*100/maxInt(dbtotal, 1), left,
+				tp.GetStat().Doing, doneload, dbtotal, donesizem, dataspeed)
 		})
 
-		for loading != 0 {
-			time.Sleep(time.Millisecond * 10)
+		err := b.ForEach(func(k, v []byte) error {
+			return tp.AddJob(LoadFileInfo{k, v})
+		})
+		werr := tp.Wait()
+		stop()
+		if err == nil {
+			err = werr
+		}
+		if err != nil {
+			return err
 		}
 
-		tp.Stop()
-
+		tb := tx.Bucket([]byte(tile_bucket_name))
 		for _, k := range need_del {
 			b.Delete([]byte(k))
+			tb.Delete([]byte(k))
 		}
 
 		return nil
 	})
+	if err != nil {
+		log.Printf("load_lib load database fail %s %s", database, err)
+		return err
+	}
 
 	log.Printf("load_lib load database ok")
+	metricPhase.Observe("check", time.Since(beginload))
 
 	log.Printf("load_lib start get image file list")
+	beginscan := time.Now()
 	imagefilelist := make([]CalFileInfo, 0)
 	cached := 0
-	filepath.Walk(lib, func(path string, f os.FileInfo, err error) error {
-		if f == nil || f.IsDir() {
-			return nil
-		}
-
-		if !strings.HasSuffix(strings.ToLower(f.Name()), ".jpeg") &&
-			!strings.HasSuffix(strings.ToLower(f.Name()), ".jpg") &&
-			!strings.HasSuffix(strings.ToLower(f.Name()), ".png") &&
-			!strings.HasSuffix(strings.ToLower(f.Name()), ".gif") {
+	unsupported := make([]string, 0)
+	// add lists abspath unless it is cached, the pics of an archive are listed as archive!/path,
+	// archives in archives are not opened
+	var add func(abspath string, inarchive bool)
+	add = func(abspath string, inarchive bool) {
+		var incache bool
+		db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(bucket_name))
+			tb := tx.Bucket([]byte(tile_bucket_name))
+			incache = b.Get([]byte(abspath)) != nil && tb.Get([]byte(abspath)) != nil
 			return nil
+		})
+		if incache {
+			cached++
+			return
 		}
 
-		abspath, err := filepath.Abs(path)
+		format, err := sniff_format(libfs, abspath)
 		if err != nil {
-			log.Printf("load_lib get Abs fail %s %s %s", database, path, err)
-			return nil
+			log.Printf("load_lib sniff_format fail %s %s %s", database, abspath, err)
+			return
 		}
-
-		db.View(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte(bucket_name))
-			v := b.Get([]byte(abspath))
-			if v == nil {
-				imagefilelist = append(imagefilelist, CalFileInfo{fi: FileInfo{abspath, 0, 0, 0, ""}})
-			} else {
-				cached++
+		if isArchive(format) && !inarchive {
+			files, err := libfs.Files(abspath, format)
+			if err != nil {
+				unsupported = append(unsupported, abspath)
+				return
 			}
-			return nil
-		})
+			for _, filename := range files {
+				add(filename, true)
+			}
+			return
+		}
+		if format == "" || isArchive(format) {
+			unsupported = append(unsupported, abspath)
+			return
+		}
 
+		imagefilelist = append(imagefilelist, CalFileInfo{fi: FileInfo{Filename: abspath}})
+	}
+	fs.WalkDir(libfs, lib, func(abspath string, f fs.DirEntry, err error) error {
+		if f == nil || f.IsDir() {
+			return nil
+		}
+		add(abspath, false)
 		return nil
 	})
 
-	log.Printf("load_lib get image file list ok %d cache %d", len(imagefilelist), cached)
+	log.Printf("load_lib get image file list ok %d cache %d unsupported %d", len(imagefilelist), cached, len(unsupported))
+	metricPhase.Observe("scan", time.Since(beginscan))
+	metricUnsupported.Add(int64(len(unsupported)))
 
 	log.Printf("load_lib start calc image avg color %d", len(imagefilelist))
-	var worker int32
 	begin := time.Now()
-	last := time.Now()
 	var done int32
 	var donesize int64
+	var saved int32
 
-	atomic.AddInt32(&worker, 1)
-	var save_inter int
-	go save_to_database(&worker, &imagefilelist, db, &save_inter, bucket_name)
-
-	scale := getScaler(scalealg)
+	savech := make(chan *CalFileInfo, workernum)
+	savedone := make(chan struct{})
+	go func() {
+		defer close(savedone)
+		save_to_database(savech, db, &saved, bucket_name, tile_bucket_name)
+	}()
 
-	tp := NewThreadPool(workernum, 16, func(in interface{}) {
-		i := in.(int)
-		calc_avg_color(&imagefilelist[i], &worker, &done, &donesize, scale, pixelsize)
+	tp := NewThreadPool(ctx, workernum, 16, func(ctx context.Context, in interface{}) error {
+		cfi := &imagefilelist[in.(int)]
+		calc_avg_color(libfs, cfi, &done, &donesize, opt)
+		if !cfi.ok {
+			return nil
+		}
+		select {
+		case savech <- cfi:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	})
 
-	i := 0
-	for worker != 0 {
-		if i < len(imagefilelist) {
-			ret := tp.AddJobTimeout(int(rand.Int()), i, 10)
-			if ret {
-				atomic.AddInt32(&worker, 1)
-				i++
-			}
-		} else {
-			time.Sleep(time.Millisecond * 10)
+	stop := every_second(func() {
+		done := atomic.LoadInt32(&done)
+		speed := float64(done) / float64(int(time.Now().Sub(begin))/int(time.Second))
+		left := ""
+		if speed > 0 {
+			left = time.Duration(int64(float64(len(imagefilelist)-int(done))/speed) * int64(time.Second)).String()
 		}
-		if time.Now().Sub(last) >= time.Second {
-			last = time.Now()
-			speed := float64(done) / float64(int(time.Now().Sub(begin))/int(time.Second))
-			left := ""
-			if speed > 0 {
-				left = time.Duration(int64(float64(len(imagefilelist)-int(done))/speed) * int64(time.Second)).String()
-			}
-			donesizem := donesize / 1024 / 1024
-			dataspeed := int(donesizem) / (int(time.Now().Sub(begin)) / int(time.Second))
-			log.Printf("calc speed=%.2f/s percent=%d%% time=%s thead=%d progress=%d/%d saved=%d data=%dM dataspeed=%dM/s", speed, int(done)*100/len(imagefilelist),
-				left, int(worker), int(done), len(imagefilelist), save_inter, donesizem, dataspeed)
+		donesizem := atomic.LoadInt64(&donesize) / 1024 / 1024
+		dataspeed := int(donesizem) / (int(time.Now().Sub(begin)) / int(time.Second))
+		log.Printf("calc speed=%.2f/s percent=%d%% time=%s thead=%d progress=%d/%d saved=%d data=%dM dataspeed=%dM/s", speed, int(done)*100/maxInt(len(imagefilelist), 1),
+			left, tp.GetStat().Doing, int(done), len(imagefilelist), atomic.LoadInt32(&saved), donesizem, dataspeed)
+		progress("index", int(done), len(imagefilelist))
+	})
+
+	for i := range imagefilelist {
+		if tp.AddJob(i) != nil {
+			break
 		}
 	}
-	tp.Stop()
+	err = tp.Wait()
+	stop()
+	close(savech)
+	<-savedone
+	if err != nil {
+		log.Printf("load_lib calc image avg color fail %s %s", lib, err)
+		return err
+	}
 
 	log.Printf("load_lib calc image avg color ok %d %d", len(imagefilelist), done)
+	progress("index", int(done), len(imagefilelist))
+
+	failed := 0
+	for i := range imagefilelist {
+		if !imagefilelist[i].ok {
+			failed++
+		}
+	}
+	for _, filename := range unsupported {
+		log.Printf("load_lib unsupported file %s", filename)
+	}
+	log.Printf("load_lib summary new %d cached %d failed %d unsupported %d", len(imagefilelist)-failed, cached, failed, len(unsupported))
+	metricPhase.Observe("index", time.Since(begin))
+	metricIndexed.Add(int64(len(imagefilelist) - failed))
+	metricIndexFailures.Add(int64(failed))
 
 	log.Printf("load_lib start save image avg color")
 
@@ -583,6 +952,20 @@ func load_lib(lib string, workernum int, database string, pixelsize int, scaleal
 	return nil
 }
 
+// get_bucket_name returns the FileInfo and Tile bucket names of a lib for one kind of tile, square center cropped tiles keep the old names
+func get_bucket_name(libname string, opt TileOption) (string, string) {
+	size := strconv.Itoa(opt.Width)
+	if opt.Width != opt.Height {
+		size += "x" + strconv.Itoa(opt.Height)
+	}
+	if opt.Fit != "Crop" {
+		size += opt.Fit
+	} else if opt.Crop != "Center" {
+		size += opt.Crop
+	}
+	return "FileInfo" + libname + size, "Tile" + libname + size
+}
+
 func make_key(r uint8, g uint8, b uint8) int {
 	return int(r)*256*256 + int(g)*256 + int(b)
 }
@@ -591,51 +974,51 @@ func make_string(r uint8, g uint8, b uint8) string {
 	return "r " + strconv.Itoa(int(r)) + " g " + strconv.Itoa(int(g)) + " b " + strconv.Itoa(int(b))
 }
 
-func calc_img(src image.Image, filename string, scaler draw.Scaler, pixelsize int) (image.Image, error) {
+// calc_img crops src to box and scales it down to a tile
+func calc_img(src image.Image, filename string, opt TileOption, box image.Rectangle) (image.Image, error) {
 	bounds := src.Bounds()
+	tilew := opt.Width
+	tileh := opt.Height
 
-	len := minInt(bounds.Dx(), bounds.Dy())
-	startx := bounds.Min.X + (bounds.Dx()-len)/2
-	starty := bounds.Min.Y + (bounds.Dy()-len)/2
-	endx := minInt(startx+len, bounds.Max.X)
-	endy := minInt(starty+len, bounds.Max.Y)
+	box = box.Intersect(bounds)
+	lenx := box.Dx()
+	leny := box.Dy()
 
-	if startx != bounds.Min.X || starty != bounds.Min.Y || endx != bounds.Max.X || endy != bounds.Max.Y {
-		dst := image.NewRGBA(image.Rectangle{image.Point{0, 0}, image.Point{len, len}})
-		draw.Copy(dst, image.Point{0, 0}, src, image.Rectangle{image.Point{startx, starty}, image.Point{endx, endy}}, draw.Over, nil)
+	if box != bounds {
+		dst := image.NewRGBA(image.Rectangle{image.Point{0, 0}, image.Point{lenx, leny}})
+		draw.Copy(dst, image.Point{0, 0}, src, box, draw.Over, nil)
 		src = dst
 	}
 
+	if opt.Fit != "Crop" {
+		return fit_img(src, filename, opt)
+	}
+
 	bounds = src.Bounds()
-	if bounds.Dx() != bounds.Dy() {
+	if bounds.Dx() != lenx || bounds.Dy() != leny {
 		log.Printf("calc_img cult image fail %s %d %d", filename, bounds.Dx(), bounds.Dy())
 		return nil, errors.New("bounds error")
 	}
 
-	len = minInt(bounds.Dx(), bounds.Dy())
-	if len < pixelsize {
-		log.Printf("calc_img image too small %s %d %d", filename, len, pixelsize)
+	if (bounds.Dx() < tilew || bounds.Dy() < tileh) && !opt.Upscale {
+		log.Printf("calc_img image too small %s %d*%d %d*%d", filename, bounds.Dx(), bounds.Dy(), tilew, tileh)
 		return nil, errors.New("too small")
 	}
 
-	if len > pixelsize {
-		rect := image.Rectangle{image.Point{0, 0}, image.Point{pixelsize, pixelsize}}
+	if bounds.Dx() != tilew || bounds.Dy() != tileh {
+		rect := image.Rectangle{image.Point{0, 0}, image.Point{tilew, tileh}}
 		dst := image.NewRGBA(rect)
-		scaler.Scale(dst, rect, src, src.Bounds(), draw.Over, nil)
+		opt.Scaler.Scale(dst, rect, src, src.Bounds(), draw.Over, nil)
 		src = dst
 	}
 
 	return src, nil
 }
 
-func calc_avg_color(cfi *CalFileInfo, worker *int32, done *int32, donesize *int64, scaler draw.Scaler, pixelsize int) {
-	defer atomic.AddInt32(worker, -1)
+func calc_avg_color(libfs fs.FS, cfi *CalFileInfo, done *int32, donesize *int64, opt TileOption) {
 	defer atomic.AddInt32(done, 1)
-	defer func() {
-		cfi.done = true
-	}()
 
-	reader, err := os.Open(cfi.fi.Filename)
+	reader, err := libfs.Open(cfi.fi.Filename)
 	if err != nil {
 		log.Printf("calc_avg_color Open fail %s %s", cfi.fi.Filename, err)
 		return
@@ -650,36 +1033,29 @@ func calc_avg_color(cfi *CalFileInfo, worker *int32, done *int32, donesize *int6
 	filesize := fi.Size()
 	defer atomic.AddInt64(donesize, filesize)
 
-	img, _, err := image.Decode(reader)
+	img, _, err := decode_img(reader)
 	if err != nil {
 		log.Printf("calc_avg_color Decode image fail %s %s", cfi.fi.Filename, err)
 		return
 	}
 
-	img, err = calc_img(img, cfi.fi.Filename, scaler, pixelsize)
+	box := crop_box(img, opt)
+	img, err = calc_img(img, cfi.fi.Filename, opt, box)
 	if err != nil {
 		log.Printf("calc_avg_color calc_img image fail %s %s", cfi.fi.Filename, err)
 		return
 	}
 
-	bounds := img.Bounds()
-
-	var sumR, sumG, sumB, count float64
-
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r, g, b, _ := img.At(x, y).RGBA()
-			r, g, b = r>>8, g>>8, b>>8
-
-			sumR += float64(r)
-			sumG += float64(g)
-			sumB += float64(b)
+	avg := avg_color(img)
+	grid := grid_color(img)
 
-			count += 1
-		}
+	tile, err := encode_tile(img)
+	if err != nil {
+		log.Printf("calc_avg_color encode_tile fail %s %s", cfi.fi.Filename, err)
+		return
 	}
 
-	readerhash, err := os.Open(cfi.fi.Filename)
+	readerhash, err := libfs.Open(cfi.fi.Filename)
 	if err != nil {
 		log.Printf("calc_avg_color Open fail %s %s", cfi.fi.Filename, err)
 		return
@@ -688,280 +1064,454 @@ func calc_avg_color(cfi *CalFileInfo, worker *int32, done *int32, donesize *int6
 
 	b, err := ioutil.ReadAll(readerhash)
 	if err != nil {
-		log.Printf("calc_avg_color ReadAll fail %s %d", cfi.fi.Filename, pixelsize)
+		log.Printf("calc_avg_color ReadAll fail %s %s", cfi.fi.Filename, err)
 		return
 	}
 
-	cfi.fi.R = uint8(sumR / count)
-	cfi.fi.G = uint8(sumG / count)
-	cfi.fi.B = uint8(sumB / count)
+	cfi.fi.R = avg.R
+	cfi.fi.G = avg.G
+	cfi.fi.B = avg.B
 	cfi.fi.Hash = GetXXHashString(string(b))
+	cfi.fi.Crop = box
+	cfi.fi.Grid = grid
+	cfi.fi.Version = fileInfoVersion
+	cfi.tile = tile
 	cfi.ok = true
 
 	return
 }
 
-func save_to_database(worker *int32, imagefilelist *[]CalFileInfo, db *bolt.DB, save_inter *int, bucket_name string) {
-	defer atomic.AddInt32(worker, -1)
+func avg_color(img image.Image) color.RGBA {
+	bounds := img.Bounds()
 
-	i := 0
-	for {
-		if i >= len(*imagefilelist) {
-			return
+	var sumR, sumG, sumB, count float64
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			r, g, b = r>>8, g>>8, b>>8
+
+			sumR += float64(r)
+			sumG += float64(g)
+			sumB += float64(b)
+
+			count += 1
 		}
+	}
 
-		cfi := (*imagefilelist)[i]
-		if cfi.done {
-			i++
+	return color.RGBA{uint8(sumR / count), uint8(sumG / count), uint8(sumB / count), 0}
+}
 
-			if cfi.ok {
-				var b bytes.Buffer
+// grid_color returns the avg colors of the 2*2 grid of img
+func grid_color(img image.Image) [4]color.RGBA {
+	bounds := img.Bounds()
+	midx := bounds.Min.X + bounds.Dx()/2
+	midy := bounds.Min.Y + bounds.Dy()/2
+
+	var grid [4]color.RGBA
+	for i, rect := range []image.Rectangle{
+		image.Rect(bounds.Min.X, bounds.Min.Y, midx, midy),
+		image.Rect(midx, bounds.Min.Y, bounds.Max.X, midy),
+		image.Rect(bounds.Min.X, midy, midx, bounds.Max.Y),
+		image.Rect(midx, midy, bounds.Max.X, bounds.Max.Y),
+	} {
+		if rect.Empty() {
+			rect = bounds
+		}
+		grid[i], _ = region_color(img, rect)
+	}
+	return grid
+}
 
-				enc := gob.NewEncoder(&b)
-				err := enc.Encode(&cfi.fi)
-				if err != nil {
-					log.Printf("calc_avg_color Encode FileInfo fail %s %s", cfi.fi.Filename, err)
-					return
-				}
+func save_to_database(savech <-chan *CalFileInfo, db *bolt.DB, saved *int32, bucket_name string, tile_bucket_name string) {
+	for cfi := range savech {
+		var b bytes.Buffer
 
-				k := []byte(cfi.fi.Filename)
-				v := b.Bytes()
+		enc := gob.NewEncoder(&b)
+		err := enc.Encode(&cfi.fi)
+		if err != nil {
+			log.Printf("save_to_database Encode FileInfo fail %s %s", cfi.fi.Filename, err)
+			continue
+		}
 
-				db.Update(func(tx *bolt.Tx) error {
-					b := tx.Bucket([]byte(bucket_name))
-					err := b.Put(k, v)
-					return err
-				})
-			}
+		k := []byte(cfi.fi.Filename)
+		v := b.Bytes()
 
-			*save_inter = i
-		} else {
-			time.Sleep(time.Millisecond * 10)
+		err = db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(bucket_name))
+			err := b.Put(k, v)
+			if err != nil {
+				return err
+			}
+			tb := tx.Bucket([]byte(tile_bucket_name))
+			return tb.Put(k, cfi.tile)
+		})
+		if err != nil {
+			log.Printf("save_to_database Put fail %s %s", cfi.fi.Filename, err)
 		}
+
+		cfi.tile = nil
+		atomic.AddInt32(saved, 1)
 	}
 }
 
-func gen_target(srcimg image.Image, target string, workernum int, database string, pixelsize int, maxsize int, scalealg string, libname string, cachemap *sync.Map) error {
-	log.Printf("gen_target %s", target)
+func gen_target(ctx context.Context, srcimg image.Image, detail image.Image, target string, libfs fs.FS, workernum int, database string, opt TileOption, maxsize int, libname string, cachesize int, quadtree int, quadlimit float64, layout string, background color.RGBA, transforms []Transform, seed int64, dither bool, weight image.Image, reusepenalty float64, format string, progress func(string, int, int), tilestat func(TileCacheStat)) (*image.RGBA, []Placement, error) {
+	log.Printf("gen_target %s seed %d", target, seed)
 
 	db, err := bolt.Open(database, 0o600, nil)
 	if err != nil {
 		log.Printf("gen_target Open database fail %s %s", database, err)
-		return err
+		return nil, nil, err
 	}
 	defer db.Close()
 
-	bucket_name := "FileInfo" + libname + strconv.Itoa(pixelsize)
+	bucket_name, tile_bucket_name := get_bucket_name(libname, opt)
 
 	bounds := srcimg.Bounds()
 
-	startx := bounds.Min.X
-	starty := bounds.Min.Y
-	endx := bounds.Max.X
-	endy := bounds.Max.Y
+	fis, err := load_fileinfos(db, bucket_name)
+	if err != nil {
+		log.Printf("gen_target load_fileinfos fail %s %s", bucket_name, err)
+		return nil, nil, err
+	}
+	if len(fis) <= 0 {
+		return nil, nil, errors.New("no pic")
+	}
+
+	masks := NewMaskCache(layout, opt.Width, opt.Height)
+	cells := gen_cells(srcimg, detail, masks, quadtree, quadlimit)
+	mc := NewMatchCache()
+
+	if dither {
+		err = dither_cells(ctx, cells, bounds.Dx(), bounds.Dy(), opt, fis, transforms, seed, mc)
+		if err != nil {
+			log.Printf("gen_target dither fail %s %s", target, err)
+			return nil, nil, err
+		}
+	}
+
+	if weight != nil {
+		err = weight_cells(ctx, cells, weight, image.Point{bounds.Dx() * opt.Width, bounds.Dy() * opt.Height}, masks, fis, transforms, seed, reusepenalty, mc)
+		if err != nil {
+			log.Printf("gen_target weight fail %s %s", target, err)
+			return nil, nil, err
+		}
+	}
 
-	last := time.Now()
+	return draw_target(ctx, target, cells, masks, image.Point{bounds.Dx() * opt.Width, bounds.Dy() * opt.Height}, libfs, db, fis, tile_bucket_name, opt, transforms, seed, mc, workernum, maxsize, cachesize, background, format, progress, tilestat)
+}
+
+// draw_target draws the tile of every cell into a target of size, cells without a Match are matched first
+func draw_target(ctx context.Context, target string, cells []Cell, masks *MaskCache, size image.Point, libfs fs.FS, db *bolt.DB, fis []FileInfo, tile_bucket_name string, opt TileOption, transforms []Transform, seed int64, mc *MatchCache, workernum int, maxsize int, cachesize int, background color.RGBA, format string, progress func(string, int, int), tilestat func(TileCacheStat)) (*image.RGBA, []Placement, error) {
 	begin := time.Now()
-	total := bounds.Dx() * bounds.Dy()
+	total := len(cells)
 	var done int32
-	var doing int32
 	var cached int32
 
-	lenx := bounds.Dx() * pixelsize
-	leny := bounds.Dy() * pixelsize
+	lenx := size.X
+	leny := size.Y
 
 	outputfilesize := lenx * leny * 4 / 1024 / 1024 / 1024
 	if outputfilesize > maxsize {
-		log.Printf("gen_target too big %s %dG than %dG", target, outputfilesize, maxsize)
-		return errors.New("too big")
+		log.Printf("draw_target too big %s %dG than %dG", target, outputfilesize, maxsize)
+		return nil, nil, errors.New("too big")
 	}
 
-	log.Printf("gen_target start gen pixel %s %dG max %dG", target, outputfilesize, maxsize)
+	err := check_target(format, lenx, leny)
+	if err != nil {
+		log.Printf("draw_target check_target fail %s %s", target, err)
+		return nil, nil, err
+	}
 
-	dst := image.NewRGBA(image.Rectangle{image.Point{0, 0}, image.Point{lenx, leny}})
+	log.Printf("draw_target start gen pixel %s %dG max %dG cells %d", target, outputfilesize, maxsize, total)
 
-	type GenInfo struct {
-		x int
-		y int
-		c color.RGBA
+	dst := image.NewRGBA(image.Rectangle{image.Point{0, 0}, image.Point{lenx, leny}})
+	if masks.layout == "Circle" {
+		draw.Draw(dst, dst.Bounds(), &image.Uniform{background}, image.Point{}, draw.Src)
 	}
 
-	tp := NewThreadPool(workernum, 16, func(in interface{}) {
+	tc := NewTileCache(int64(cachesize) * 1024 * 1024)
+
+	placements := make([]Placement, len(cells))
+
+	tp := NewThreadPool(ctx, workernum, 16, func(ctx context.Context, in interface{}) error {
 		defer atomic.AddInt32(&done, 1)
-		defer atomic.AddInt32(&doing, -1)
-		gi := in.(GenInfo)
-		gen_target_pixel(gi.c, gi.x, gi.y, dst, db, bucket_name, pixelsize, scalealg, cachemap, &cached)
+		i := in.(int)
+		err := gen_target_pixel(cells[i], masks.Get(cells[i]), dst, libfs, db, fis, tile_bucket_name, opt, transforms, seed, mc, tc, &cached, &placements[i])
+		if err == nil {
+			metricTilesPlaced.Add(1)
+		}
+		return err
 	})
 
-	for y := starty; y < endy; y++ {
-		for x := startx; x < endx; x++ {
-			r, g, b, _ := srcimg.At(x, y).RGBA()
-			r, g, b = r>>8, g>>8, b>>8
-
-			for {
-				ret := tp.AddJobTimeout(int(rand.Int()), GenInfo{x: x, y: y, c: color.RGBA{uint8(r), uint8(g), uint8(b), 0}}, 10)
-				if ret {
-					atomic.AddInt32(&doing, 1)
-					break
-				}
-			}
+	stop := every_second(func() {
+		done := atomic.LoadInt32(&done)
+		cached := atomic.LoadInt32(&cached)
+		speed := float64(done) / float64(int(time.Now().Sub(begin))/int(time.Second))
+		left := ""
+		if speed > 0 {
+			left = time.Duration(int64(float64(total-int(done))/speed) * int64(time.Second)).String()
+		}
+		tcs := tc.GetStat()
+		log.Printf("gen speed=%.2f/s percent=%d%% time=%s thead=%d progress=%d/%d cached=%d cached-percent=%d%% tile-cache=%d/%dM tile-hit=%d tile-miss=%d",
+			speed, int(done)*100/total, left, tp.GetStat().Doing, int(done), total, cached, int(cached)*100/total,
+			tcs.Num, tcs.Size/1024/1024, tcs.Hit, tcs.Miss)
+		tilestat(tcs)
+		progress("draw", int(done), total)
+	})
 
-			if time.Now().Sub(last) >= time.Second {
-				last = time.Now()
-				speed := float64(done) / float64(int(time.Now().Sub(begin))/int(time.Second))
-				left := ""
-				if speed > 0 {
-					left = time.Duration(int64(float64(total-int(done))/speed) * int64(time.Second)).String()
-				}
-				log.Printf("gen speed=%.2f/s percent=%d%% time=%s thead=%d progress=%d/%d cached=%d cached-percent=%d%%", speed, int(done)*100/total,
-					left, int(doing), int(done), total, cached, int(cached)*100/total)
-			}
+	for i := range cells {
+		if tp.AddJob(i) != nil {
+			break
 		}
 	}
 
-	for doing != 0 {
-		time.Sleep(time.Millisecond * 10)
+	err = tp.Wait()
+	stop()
+	if err != nil {
+		log.Printf("draw_target gen pixel fail %s %s", target, err)
+		return nil, nil, err
 	}
 
-	tp.Stop()
+	tcs := tc.GetStat()
+	log.Printf("draw_target gen pixel ok %s tile-hit=%d tile-miss=%d", target, tcs.Hit, tcs.Miss)
+	metricPhase.Observe("draw", time.Since(begin))
+	tilestat(tcs)
+	progress("draw", total, total)
 
-	log.Printf("gen_target gen pixel ok %s", target)
+	return dst, placements, nil
+}
 
-	log.Printf("gen_target start write file %s", target)
-	dstFile, err := os.Create(target)
-	if err != nil {
-		log.Printf("gen_target Create fail %s %s", target, err)
-		return err
+func gen_target_pixel(cell Cell, mask *image.Alpha, dst *image.RGBA, libfs fs.FS, db *bolt.DB, fis []FileInfo, tile_bucket_name string, opt TileOption, transforms []Transform, seed int64, mc *MatchCache, tc *TileCache, cached *int32, placement *Placement) error {
+	var mindiff FileInfo
+	var transform Transform
+	if cell.Match != nil {
+		mindiff, transform = cell.Match.FileInfo, cell.Match.Transform
+	} else {
+		var shared bool
+		var err error
+		mindiff, transform, shared, err = match_cell(cell, fis, transforms, seed, mc)
+		if err != nil {
+			return err
+		}
+		if shared {
+			atomic.AddInt32(cached, 1)
+		}
 	}
-	defer dstFile.Close()
 
-	if strings.HasSuffix(strings.ToLower(target), ".png") {
-		err = png.Encode(dstFile, dst)
-	} else if strings.HasSuffix(strings.ToLower(target), ".jpg") {
-		err = jpeg.Encode(dstFile, dst, &jpeg.Options{Quality: 100})
+	tilekey := mindiff.Filename
+	if cell.Size > 1 {
+		tilekey += "@" + strconv.Itoa(cell.Size)
 	}
+
+	minimg, err := tc.GetOrLoad(tilekey, func() (image.Image, error) {
+		return load_tile(libfs, db, tile_bucket_name, mindiff, opt, cell.Size)
+	})
 	if err != nil {
-		log.Printf("gen_target Encode fail %s %s", target, err)
 		return err
 	}
 
-	log.Printf("gen_target write file ok %s", target)
+	minimg = transform.Apply(minimg)
+
+	if mask == nil {
+		draw.Copy(dst, cell.Rect.Min, minimg, minimg.Bounds(), draw.Over, nil)
+	} else {
+		draw_masked(dst, cell.Rect, minimg, mask)
+	}
 
+	*placement = Placement{X: cell.X, Y: cell.Y, Size: cell.Size, Rect: cell.Rect, Filename: mindiff.Filename, Hash: mindiff.Hash,
+		Distance: grid_distance(transform.Grid(tile_grid(mindiff)), cell.Grid), Transform: transform.Name}
 	return nil
 }
 
-func gen_target_pixel(src color.RGBA, x int, y int, dst *image.RGBA, db *bolt.DB, bucket_name string, pixelsize int, scalealg string, cachemap *sync.Map, cached *int32) {
-	var minimgs []image.Image
+// draw_masked draws tile over rect of dst where mask lets it through and leaves the pixels the mask hides untouched,
+// as draw.DrawMask writes every pixel of rect back and Hex rects overlap the ones of the cells drawn beside them
+func draw_masked(dst *image.RGBA, rect image.Rectangle, tile image.Image, mask *image.Alpha) {
+	sp := tile.Bounds().Min
+	w := minInt(rect.Dx(), mask.Rect.Dx())
+	h := minInt(rect.Dy(), mask.Rect.Dy())
+	for y := 0; y < h; y++ {
+		row := mask.Pix[y*mask.Stride : y*mask.Stride+w]
+		for x := 0; x < w; {
+			end := x + 1
+			switch row[x] {
+			case 0:
+			case 255:
+				for end < w && row[end] == 255 {
+					end++
+				}
+				r := image.Rect(rect.Min.X+x, rect.Min.Y+y, rect.Min.X+end, rect.Min.Y+y+1)
+				draw.Draw(dst, r, tile, sp.Add(image.Pt(x, y)), draw.Over)
+			default:
+				r := image.Rect(rect.Min.X+x, rect.Min.Y+y, rect.Min.X+end, rect.Min.Y+y+1)
+				draw.DrawMask(dst, r, tile, sp.Add(image.Pt(x, y)), mask, image.Pt(x, y), draw.Over)
+			}
+			x = end
+		}
+	}
+}
+
+// Match is the tile a cell is drawn with
+type Match struct {
+	FileInfo  FileInfo
+	Transform Transform
+}
 
+// match_cell returns the tile and transform for cell, the same cell and seed always get the same ones
+func match_cell(cell Cell, fis []FileInfo, transforms []Transform, seed int64, mc *MatchCache) (FileInfo, Transform, bool, error) {
+	src := cell.C
 	key := make_string(src.R, src.G, src.B)
-	v, ok := cachemap.Load(key)
-	if ok {
-		ci := v.(*CacheInfo)
-		minimgs = ci.img
+	mindiffs, shared, err := mc.Do(key, func() ([]FileInfo, error) {
+		return find_min_diff(fis, src), nil
+	})
+	if err != nil {
+		return FileInfo{}, TransformNone, false, err
+	}
+	if len(mindiffs) <= 0 {
+		return FileInfo{}, TransformNone, false, errors.New("no pic")
 	}
 
-	if len(minimgs) <= 0 {
-		if ok {
-			ci := v.(*CacheInfo)
-			ci.lock.Lock()
+	fi, transform, _ := pick_tile(mindiffs, cell, transforms, cell_rand(seed, cell))
+	return fi, transform, shared, nil
+}
+
+// load_fileinfos reads all the FileInfo of the lib from the database
+func load_fileinfos(db *bolt.DB, bucket_name string) ([]FileInfo, error) {
+	var fis []FileInfo
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket_name))
+		if b == nil {
+			return nil
 		}
+		return b.ForEach(func(k, v []byte) error {
+			var b bytes.Buffer
+			b.Write(v)
 
-		if len(minimgs) <= 0 {
-
-			mindiff := math.MaxFloat64
-			var mindiffnames []string
-			var minfi FileInfo
-
-			db.View(func(tx *bolt.Tx) error {
-				b := tx.Bucket([]byte(bucket_name))
-				b.ForEach(func(k, v []byte) error {
-					var b bytes.Buffer
-					b.Write(v)
-
-					dec := gob.NewDecoder(&b)
-					var fi FileInfo
-					err := dec.Decode(&fi)
-					if err != nil {
-						log.Printf("gen_target_pixel database Decode fail %s %s", string(k), err)
-						os.Exit(1)
-					}
-
-					if minfi.R == fi.R && minfi.G == fi.G && minfi.B == fi.B {
-						mindiffnames = append(mindiffnames, fi.Filename)
-						return nil
-					}
-
-					tmp := color.RGBA{fi.R, fi.G, fi.B, 0}
-					diff := ColorDistance(src, tmp)
-					if diff < mindiff {
-						mindiff = diff
-						mindiffnames = mindiffnames[:0]
-						mindiffnames = append(mindiffnames, fi.Filename)
-						minfi = fi
-					}
+			dec := gob.NewDecoder(&b)
+			var fi FileInfo
+			err := dec.Decode(&fi)
+			if err != nil {
+				log.Printf("load_fileinfos database Decode fail %s %s", string(k), err)
+				return err
+			}
 
-					return nil
-				})
-				return nil
-			})
+			fis = append(fis, fi)
+			return nil
+		})
+	})
 
-			for _, mindiffname := range mindiffnames {
-				reader, err := os.Open(mindiffname)
-				if err != nil {
-					log.Printf("gen_target_pixel Open fail %s %s", mindiffname, err)
-					os.Exit(1)
-				}
-				defer reader.Close()
+	return fis, err
+}
 
-				minimg, _, err := image.Decode(reader)
-				if err != nil {
-					log.Printf("gen_target_pixel Decode fail %s %s", mindiffname, err)
-					return
-				}
+// find_min_diff returns the files whose avg color is closest to src
+func find_min_diff(fis []FileInfo, src color.RGBA) []FileInfo {
+	mindiff := math.MaxFloat64
+	var mindiffs []FileInfo
+	var minfi FileInfo
 
-				scale := getScaler(scalealg)
+	for _, fi := range fis {
+		if len(mindiffs) > 0 && minfi.R == fi.R && minfi.G == fi.G && minfi.B == fi.B {
+			mindiffs = append(mindiffs, fi)
+			continue
+		}
 
-				minimg, err = calc_img(minimg, mindiffname, scale, pixelsize)
-				if err != nil {
-					log.Printf("gen_target_pixel calc_img image fail %s %s", mindiffname, err)
-					return
-				}
+		tmp := color.RGBA{fi.R, fi.G, fi.B, 0}
+		diff := ColorDistance(src, tmp)
+		if diff < mindiff {
+			mindiff = diff
+			mindiffs = mindiffs[:0]
+			mindiffs = append(mindiffs, fi)
+			minfi = fi
+		}
+	}
 
-				minimgs = append(minimgs, minimg)
-			}
+	return mindiffs
+}
 
-			v, ok := cachemap.Load(key)
-			if ok {
-				ci := v.(*CacheInfo)
-				ci.img = minimgs
-			}
-		} else {
-			atomic.AddInt32(cached, 1)
+// load_tile returns the tile of fi that covers size*size cells, only single cell tiles are in the database
+func load_tile(libfs fs.FS, db *bolt.DB, tile_bucket_name string, fi FileInfo, opt TileOption, size int) (image.Image, error) {
+	filename := fi.Filename
+
+	var tile []byte
+	db.View(func(tx *bolt.Tx) error {
+		if size > 1 {
+			return nil
 		}
+		tb := tx.Bucket([]byte(tile_bucket_name))
+		if tb == nil {
+			return nil
+		}
+		v := tb.Get([]byte(filename))
+		if v != nil {
+			tile = make([]byte, len(v))
+			copy(tile, v)
+		}
+		return nil
+	})
 
-		if ok {
-			ci := v.(*CacheInfo)
-			ci.lock.Unlock()
+	if tile != nil {
+		img, err := decode_tile(tile)
+		if err == nil {
+			return img, nil
 		}
-	} else {
-		atomic.AddInt32(cached, 1)
+		log.Printf("load_tile decode_tile fail, read from file %s %s", filename, err)
+	}
+
+	reader, err := libfs.Open(filename)
+	if err != nil {
+		log.Printf("load_tile Open fail %s %s", filename, err)
+		return nil, err
 	}
+	defer reader.Close()
 
-	var minimg image.Image
+	img, _, err := decode_img(reader)
+	if err != nil {
+		log.Printf("load_tile Decode fail %s %s", filename, err)
+		return nil, err
+	}
 
-	minimg = minimgs[int(rand.Int31n(int32(len(minimgs))))]
+	box := fi.Crop
+	if box.Empty() || !box.In(img.Bounds()) {
+		box = crop_box(img, opt)
+	}
 
-	if rand.Int()%2 == 0 {
-		flippedImg := image.NewRGBA(minimg.Bounds())
-		for j := 0; j < minimg.Bounds().Dy(); j++ {
-			for i := 0; i < minimg.Bounds().Dx(); i++ {
-				flippedImg.Set((minimg.Bounds().Dx()-1)-i, j, minimg.At(i, j))
-			}
+	sizeopt := opt
+	sizeopt.Width *= size
+	sizeopt.Height *= size
+
+	img, err = calc_img(img, filename, sizeopt, box)
+	if err != nil && size > 1 {
+		base, err := load_tile(libfs, db, tile_bucket_name, fi, opt, 1)
+		if err != nil {
+			return nil, err
 		}
-		minimg = flippedImg
+		rect := image.Rectangle{image.Point{0, 0}, image.Point{sizeopt.Width, sizeopt.Height}}
+		dst := image.NewRGBA(rect)
+		opt.Scaler.Scale(dst, rect, base, base.Bounds(), draw.Src, nil)
+		return dst, nil
+	}
+	if err != nil {
+		log.Printf("load_tile calc_img image fail %s %s", filename, err)
+		return nil, err
 	}
 
-	draw.Copy(dst, image.Point{x * pixelsize, y * pixelsize}, minimg, minimg.Bounds(), draw.Over, nil)
+	return img, nil
+}
+
+// encode_tile serializes a scaled tile for the tile bucket, lossless so a cached tile renders exactly like a freshly scaled one
+func encode_tile(img image.Image) ([]byte, error) {
+	var b bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.BestSpeed}
+	err := enc.Encode(&b, img)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func decode_tile(b []byte) (image.Image, error) {
+	return png.Decode(bytes.NewReader(b))
 }
 
 // MaxOfInt
@@ -1010,93 +1560,134 @@ func ColorDistance(c1 color.RGBA, c2 color.RGBA) float64 {
 		(float64(c1.B)-float64(c2.B))*(float64(c1.B)-float64(c2.B)))
 }
 
+// ThreadPool runs jobs from one shared queue on a fixed number of workers, the first job error cancels the rest
 type ThreadPool struct {
-	workResultLock sync.WaitGroup
-	max            int
-	exef           func(interface{})
-	ca             []chan interface{}
-	control        chan int
-	stat           ThreadPoolStat
+	ctx     context.Context
+	parent  context.Context
+	cancel  context.CancelFunc
+	exef    func(context.Context, interface{}) error
+	jobs    chan interface{}
+	workers sync.WaitGroup
+	once    sync.Once
+	lock    sync.Mutex
+	err     error
+	stat    ThreadPoolStat
 }
 
 type ThreadPoolStat struct {
-	Datalen    []int
-	Pushnum    []int
-	Processnum []int
+	Datalen    int
+	Doing      int64
+	Pushnum    int64
+	Processnum int64
+	Errnum     int64
 }
 
-func NewThreadPool(max int, buffer int, exef func(interface{})) *ThreadPool {
-	ca := make([]chan interface{}, max)
-	control := make(chan int, max)
-	for index := range ca {
-		ca[index] = make(chan interface{}, buffer)
-	}
+func NewThreadPool(ctx context.Context, max int, buffer int, exef func(context.Context, interface{}) error) *ThreadPool {
+	tpctx, cancel := context.WithCancel(ctx)
+	tp := &ThreadPool{ctx: tpctx, parent: ctx, cancel: cancel, exef: exef, jobs: make(chan interface{}, buffer)}
 
-	stat := ThreadPoolStat{}
-	stat.Datalen = make([]int, max)
-	stat.Pushnum = make([]int, max)
-	stat.Processnum = make([]int, max)
-
-	tp := &ThreadPool{max: max, exef: exef, ca: ca, control: control, stat: stat}
-
-	for index := range ca {
-		go tp.run(index)
+	tp.workers.Add(max)
+	for i := 0; i < max; i++ {
+		go tp.run()
 	}
 
 	return tp
 }
 
-func absInt(x int) int {
-	return int(math.Abs(float64(x)))
+// AddJob queues v, blocking while the queue is full, it fails once the context is done or a job has failed
+func (tp *ThreadPool) AddJob(v interface{}) error {
+	if tp.ctx.Err() != nil {
+		return tp.Err()
+	}
+	atomic.AddInt64(&tp.stat.Doing, 1)
+	select {
+	case tp.jobs <- v:
+		atomic.AddInt64(&tp.stat.Pushnum, 1)
+		return nil
+	case <-tp.ctx.Done():
+		atomic.AddInt64(&tp.stat.Doing, -1)
+		return tp.Err()
+	}
 }
 
-func (tp *ThreadPool) AddJob(hash int, v interface{}) {
-	tp.ca[absInt(hash)%len(tp.ca)] <- v
-	tp.stat.Pushnum[absInt(hash)%len(tp.ca)]++
+// Wait stops accepting jobs, waits for the queued ones and returns the first error
+func (tp *ThreadPool) Wait() error {
+	tp.once.Do(func() {
+		close(tp.jobs)
+	})
+	tp.workers.Wait()
+	err := tp.Err()
+	tp.cancel()
+	return err
 }
 
-func (tp *ThreadPool) AddJobTimeout(hash int, v interface{}, timeoutms int) bool {
-	select {
-	case tp.ca[absInt(hash)%len(tp.ca)] <- v:
-		tp.stat.Pushnum[absInt(hash)%len(tp.ca)]++
-		return true
-	case <-time.After(time.Duration(timeoutms) * time.Millisecond):
-		return false
+func (tp *ThreadPool) Err() error {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	if tp.err != nil {
+		return tp.err
+	}
+	if tp.parent.Err() != nil {
+		return tp.parent.Err()
 	}
+	return tp.ctx.Err()
 }
 
-func (tp *ThreadPool) Stop() {
-	for i := 0; i < tp.max; i++ {
-		tp.control <- i
+func (tp *ThreadPool) fail(err error) {
+	tp.lock.Lock()
+	if tp.err == nil {
+		tp.err = err
 	}
-	tp.workResultLock.Wait()
+	tp.lock.Unlock()
+	tp.cancel()
 }
 
-func (tp *ThreadPool) run(index int) {
-	tp.workResultLock.Add(1)
-	defer tp.workResultLock.Done()
+func (tp *ThreadPool) run() {
+	defer tp.workers.Done()
 
-	for {
-		select {
-		case <-tp.control:
-			return
-		case v := <-tp.ca[index]:
-			tp.exef(v)
-			tp.stat.Processnum[index]++
+	for v := range tp.jobs {
+		if tp.ctx.Err() == nil {
+			err := tp.exef(tp.ctx, v)
+			atomic.AddInt64(&tp.stat.Processnum, 1)
+			if err != nil {
+				atomic.AddInt64(&tp.stat.Errnum, 1)
+				tp.fail(err)
+			}
 		}
+		atomic.AddInt64(&tp.stat.Doing, -1)
 	}
 }
 
 func (tp *ThreadPool) GetStat() ThreadPoolStat {
-	for index := range tp.ca {
-		tp.stat.Datalen[index] = len(tp.ca[index])
+	return ThreadPoolStat{
+		Datalen:    len(tp.jobs),
+		Doing:      atomic.LoadInt64(&tp.stat.Doing),
+		Pushnum:    atomic.LoadInt64(&tp.stat.Pushnum),
+		Processnum: atomic.LoadInt64(&tp.stat.Processnum),
+		Errnum:     atomic.LoadInt64(&tp.stat.Errnum),
 	}
-	return tp.stat
 }
 
-func (tp *ThreadPool) ResetStat() {
-	for index := range tp.ca {
-		tp.stat.Pushnum[index] = 0
-		tp.stat.Processnum[index] = 0
+// every_second calls f once a second in the background until the returned stop is called
+func every_second(f func()) (stop func()) {
+	ticker := time.NewTicker(time.Second)
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ticker.C:
+				f()
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(quit)
+		wg.Wait()
 	}
 }
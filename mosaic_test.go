@@ -0,0 +1,378 @@
+package mosaic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/chyroc/go-ptr"
+)
+
+// the lib and gen logs of every render drown the test output
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+func TestMatchCacheDo(t *testing.T) {
+	mc := NewMatchCache()
+	want := []FileInfo{{Filename: "a"}, {Filename: "b"}}
+
+	var fills, shared int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			fis, s, err := mc.Do("key", func() ([]FileInfo, error) {
+				atomic.AddInt32(&fills, 1)
+				return want, nil
+			})
+			if err != nil || len(fis) != len(want) || fis[0] != want[0] {
+				t.Errorf("Do got %v %v", fis, err)
+			}
+			if s {
+				atomic.AddInt32(&shared, 1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if fills != 1 || shared != 31 {
+		t.Fatalf("fills %d shared %d, want 1 31", fills, shared)
+	}
+
+	wanterr := errors.New("fill fail")
+	_, _, err := mc.Do("bad", func() ([]FileInfo, error) { return nil, wanterr })
+	if err != wanterr {
+		t.Fatalf("Do err %v", err)
+	}
+}
+
+func TestTileCacheGetOrLoad(t *testing.T) {
+	tile := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	tc := NewTileCache(int64(len(tile.Pix)) * 2)
+
+	var loads int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			key := fmt.Sprintf("tile%d", i%4)
+			img, err := tc.GetOrLoad(key, func() (image.Image, error) {
+				atomic.AddInt32(&loads, 1)
+				return tile, nil
+			})
+			if err != nil || img != tile {
+				t.Errorf("GetOrLoad %s got %v %v", key, img, err)
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	stat := tc.GetStat()
+	if stat.Miss != int64(loads) || stat.Hit+stat.Miss != 32 {
+		t.Fatalf("loads %d stat %+v", loads, stat)
+	}
+	if stat.Num > 2 || stat.Size > int64(len(tile.Pix))*2 {
+		t.Fatalf("cache over its size %+v", stat)
+	}
+
+	// a failed load is not cached
+	wanterr := errors.New("load fail")
+	_, err := tc.GetOrLoad("bad", func() (image.Image, error) { return nil, wanterr })
+	if err != wanterr {
+		t.Fatalf("GetOrLoad err %v", err)
+	}
+	_, err = tc.GetOrLoad("bad", func() (image.Image, error) { return tile, nil })
+	if err != nil {
+		t.Fatalf("GetOrLoad after fail %v", err)
+	}
+}
+
+func TestThreadPoolError(t *testing.T) {
+	wanterr := errors.New("job fail")
+	var ran int32
+	tp := NewThreadPool(context.Background(), 4, 1, func(ctx context.Context, in interface{}) error {
+		atomic.AddInt32(&ran, 1)
+		if in.(int) == 3 {
+			return wanterr
+		}
+		return nil
+	})
+	for i := 0; i < 1000; i++ {
+		if tp.AddJob(i) != nil {
+			break
+		}
+	}
+	if err := tp.Wait(); err != wanterr {
+		t.Fatalf("Wait err %v", err)
+	}
+	if ran >= 1000 {
+		t.Fatalf("jobs kept running after the error, ran %d", ran)
+	}
+}
+
+// test_pic returns the i-th test lib pic, a flat png with a bright corner, so the pics differ in color and crop
+func test_pic(t *testing.T, i int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 24+i%3*8, 24))
+	c := color.RGBA{uint8(i * 37), uint8(255 - i*23), uint8(i * 61), 255}
+	for p := 0; p < len(img.Pix); p += 4 {
+		img.Pix[p], img.Pix[p+1], img.Pix[p+2], img.Pix[p+3] = c.R, c.G, c.B, c.A
+	}
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 6; x++ {
+			img.Set(x, y, color.White)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// write_test_lib writes n test pics to dir
+func write_test_lib(t *testing.T, dir string, n int) {
+	for i := 0; i < n; i++ {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%02d.png", i)), test_pic(t, i), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// test_src is a color gradient, so most cells match a different pic
+func test_src(w, h int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 255 / w), uint8(y * 255 / h), uint8((x + y) * 127 / (w + h)), 255})
+		}
+	}
+	return img
+}
+
+func test_request(lib string, database string, layout string, worker int) *Request {
+	return &Request{
+		SrcImage:  test_src(16, 12),
+		Lib:       lib,
+		Database:  ptr.String(database),
+		Worker:    ptr.Int(worker),
+		PixelSize: ptr.Int(8),
+		Columns:   ptr.Int(16),
+		Rows:      ptr.Int(12),
+		Layout:    ptr.String(layout),
+		Seed:      ptr.Int64(42),
+		CacheSize: ptr.Int(1),
+	}
+}
+
+func TestMosaicWorkers(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib")
+	if err := os.Mkdir(lib, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	write_test_lib(t, lib, 24)
+	database := filepath.Join(dir, "database.bin")
+
+	for _, layout := range []string{"Square", "Brick", "Hex", "Circle"} {
+		t.Run(layout, func(t *testing.T) {
+			var want *image.RGBA
+			for _, worker := range []int{1, 8, 8} {
+				img, err := MosaicImage(context.Background(), test_request(lib, database, layout, worker))
+				if err != nil {
+					t.Fatalf("worker %d: %s", worker, err)
+				}
+				got := img.(*image.RGBA)
+				if want == nil {
+					want = got
+					continue
+				}
+				if !bytes.Equal(got.Pix, want.Pix) {
+					t.Fatalf("worker %d renders another target than worker 1", worker)
+				}
+			}
+		})
+	}
+}
+
+// atImage records where it is read
+type atImage struct {
+	img  image.Image
+	seen map[image.Point]bool
+}
+
+func (a *atImage) ColorModel() color.Model { return a.img.ColorModel() }
+func (a *atImage) Bounds() image.Rectangle { return a.img.Bounds() }
+func (a *atImage) At(x, y int) color.Color {
+	a.seen[image.Pt(x, y)] = true
+	return a.img.At(x, y)
+}
+
+func TestDrawMaskedHex(t *testing.T) {
+	const tile = 16
+	masks := NewMaskCache("Hex", tile, tile)
+	src := image.NewRGBA(image.Rect(0, 0, tile, tile))
+	for p := range src.Pix {
+		src.Pix[p] = uint8(p)
+	}
+
+	// every pixel inside the grid is owned by the mask of exactly one cell
+	owners := make(map[image.Point]int)
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 6; x++ {
+			cell := Cell{X: x, Y: y, Size: 1}
+			cell.Rect = cell_rect("Hex", cell, tile, tile)
+			mask := masks.Get(cell)
+
+			want := image.NewRGBA(image.Rect(0, 0, 8*tile, 8*tile))
+			got := image.NewRGBA(want.Rect)
+			draw.DrawMask(want, cell.Rect, src, image.Point{}, mask, image.Point{}, draw.Over)
+			draw_masked(got, cell.Rect, src, mask)
+			if !bytes.Equal(got.Pix, want.Pix) {
+				t.Fatalf("cell %d,%d: draw_masked differs from draw.DrawMask", x, y)
+			}
+
+			// neighbour rects overlap, the tile must only be drawn where the mask owns the pixel,
+			// or the worker of this cell writes back pixels the neighbour workers are drawing
+			at := &atImage{img: src, seen: make(map[image.Point]bool)}
+			draw_masked(image.NewRGBA(want.Rect), cell.Rect, at, mask)
+			for p := range at.seen {
+				if mask.AlphaAt(p.X, p.Y).A == 0 {
+					t.Fatalf("cell %d,%d: draws the hidden pixel %v", x, y, p)
+				}
+			}
+			for py := 0; py < tile; py++ {
+				for px := 0; px < tile; px++ {
+					if mask.AlphaAt(px, py).A != 0 {
+						owners[cell.Rect.Min.Add(image.Pt(px, py))]++
+					}
+				}
+			}
+		}
+	}
+	for y := tile; y < 4*tile; y++ {
+		for x := tile; x < 5*tile; x++ {
+			if n := owners[image.Pt(x, y)]; n != 1 {
+				t.Fatalf("pixel %d,%d has %d owners", x, y, n)
+			}
+		}
+	}
+}
+
+func TestRenderManifest(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib")
+	if err := os.Mkdir(lib, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	write_test_lib(t, lib, 24)
+	database := filepath.Join(dir, "database.bin")
+
+	// the flat color of each test pic, a tile shows it away from the white corner
+	colors := make(map[string]color.RGBA)
+	for i := 0; i < 24; i++ {
+		img, _ := png.Decode(bytes.NewReader(test_pic(t, i)))
+		colors[filepath.Join(lib, fmt.Sprintf("%02d.png", i))] = color.RGBAModel.Convert(img.At(12, 12)).(color.RGBA)
+	}
+
+	for _, layout := range []string{"Square", "Brick", "Hex"} {
+		t.Run(layout, func(t *testing.T) {
+			// the same seed places the same tiles for both manifests
+			var want *Manifest
+			for _, format := range []string{"json", "csv"} {
+				req := test_request(lib, database, layout, 2)
+				req.Transform = ptr.String("All")
+				req.Crop = ptr.String("Entropy")
+				req.Manifest = ptr.String(filepath.Join(dir, layout+"."+format))
+				if _, err := MosaicImage(context.Background(), req); err != nil {
+					t.Fatalf("%s: %s", format, err)
+				}
+				if format == "json" {
+					var err error
+					if want, err = read_manifest(*req.Manifest); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if want.Columns != 16 || want.Rows != 12 || want.Width != 16*8 || want.Height != 12*8 {
+				t.Fatalf("manifest grid %d*%d size %d*%d", want.Columns, want.Rows, want.Width, want.Height)
+			}
+
+			var renders []*image.RGBA
+			for _, format := range []string{"json", "csv"} {
+				// a csv has no layout, crop, grid or seed, they come from req and the placements
+				req := &Request{
+					Lib:          lib,
+					Database:     ptr.String(database),
+					Worker:       ptr.Int(2),
+					PixelSize:    ptr.Int(12),
+					Layout:       ptr.String(layout),
+					Crop:         ptr.String("Entropy"),
+					FromManifest: ptr.String(filepath.Join(dir, layout+"."+format)),
+					Manifest:     ptr.String(filepath.Join(dir, layout+"-12."+format+".json")),
+				}
+				img, err := MosaicImage(context.Background(), req)
+				if err != nil {
+					t.Fatalf("%s: %s", format, err)
+				}
+				rgba := img.(*image.RGBA)
+				if rgba.Bounds() != image.Rect(0, 0, 16*12, 12*12) {
+					t.Fatalf("%s: bounds %v", format, rgba.Bounds())
+				}
+
+				got, err := read_manifest(*req.Manifest)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Columns != 16 || got.Rows != 12 || got.TileWidth != 12 || got.Crop != "Entropy" || len(got.Placements) != len(want.Placements) {
+					t.Fatalf("%s: manifest %d*%d tile %d crop %s placements %d", format, got.Columns, got.Rows, got.TileWidth, got.Crop, len(got.Placements))
+				}
+				for i, p := range got.Placements {
+					w := want.Placements[i]
+					if p.X != w.X || p.Y != w.Y || p.Filename != w.Filename || p.Transform != w.Transform {
+						t.Fatalf("%s: placement %d %+v want %+v", format, i, p, w)
+					}
+					if rect := cell_rect(layout, Cell{X: p.X, Y: p.Y, Size: 1}, 12, 12); p.Rect != rect {
+						t.Fatalf("%s: placement %d at %v want %v", format, i, p.Rect, rect)
+					}
+
+					// the tile is drawn where it was placed, its middle is the flat color of its pic
+					mid := image.Pt((p.Rect.Min.X+p.Rect.Max.X)/2, (p.Rect.Min.Y+p.Rect.Max.Y)/2)
+					if !mid.In(rgba.Bounds()) {
+						continue
+					}
+					c, wc := rgba.RGBAAt(mid.X, mid.Y), colors[p.Filename]
+					if absInt(int(c.R)-int(wc.R)) > 2 || absInt(int(c.G)-int(wc.G)) > 2 || absInt(int(c.B)-int(wc.B)) > 2 {
+						t.Fatalf("%s: tile %s at %v is %v want %v", format, p.Filename, mid, c, wc)
+					}
+				}
+				renders = append(renders, rgba)
+			}
+			if !bytes.Equal(renders[0].Pix, renders[1].Pix) {
+				t.Fatalf("the csv manifest renders another target than the json one")
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package mosaic
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// EncodeOption says how the target is encoded
+type EncodeOption struct {
+	JpegQuality    int
+	PngCompression png.CompressionLevel
+	Comment        string // recorded in png, jpg, tiff and opaque webp targets, bmp has no place for it
+	Progressive    bool   // Adam7 interlaced png, image/jpeg only writes baseline jpg so a progressive jpg fails, tiff/bmp/webp ignore it
+}
+
+// target_format returns the format of target by its extension, "" when it can not be written
+func target_format(target string) string {
+	switch strings.ToLower(filepath.Ext(target)) {
+	case ".png":
+		return "png"
+	case ".jpg", ".jpeg":
+		return "jpeg"
+	case ".tif", ".tiff":
+		return "tiff"
+	case ".bmp":
+		return "bmp"
+	case ".webp":
+		return "webp"
+	}
+	return ""
+}
+
+func getPngCompression(compression string) (png.CompressionLevel, bool) {
+	switch compression {
+	case "Default":
+		return png.DefaultCompression, true
+	case "None":
+		return png.NoCompression, true
+	case "BestSpeed":
+		return png.BestSpeed, true
+	case "BestCompression":
+		return png.BestCompression, true
+	}
+	return 0, false
+}
+
+// check_target returns an error when a lenx*leny target can not be encoded as format
+func check_target(format string, lenx int, leny int) error {
+	if format == "webp" && (lenx > webpMaxSize || leny > webpMaxSize) {
+		return fmt.Errorf("webp max size %d, target %d*%d", webpMaxSize, lenx, leny)
+	}
+	return nil
+}
+
+func isFormat(format string) bool {
+	return format == "png" || format == "jpeg" || format == "tiff" || format == "bmp" || format == "webp"
+}
+
+// write_target writes img to the file target
+func write_target(target string, img image.Image, format string, opt EncodeOption) error {
+	log.Printf("write_target start write file %s", target)
+	dstFile, err := os.Create(target)
+	if err != nil {
+		log.Printf("write_target Create fail %s %s", target, err)
+		return err
+	}
+	defer dstFile.Close()
+
+	err = encode_target(dstFile, img, format, opt)
+	if err != nil {
+		log.Printf("write_target Encode fail %s %s", target, err)
+		return err
+	}
+
+	log.Printf("write_target write file ok %s", target)
+	return nil
+}
+
+// encode_target encodes img as format
+func encode_target(w io.Writer, img image.Image, format string, opt EncodeOption) error {
+	begin := time.Now()
+	defer func() { metricPhase.Observe("write", time.Since(begin)) }()
+
+	bw := bufio.NewWriterSize(w, 1<<20)
+
+	var err error
+	switch format {
+	case "png":
+		if opt.Progressive {
+			err = encode_png_interlaced(bw, img, opt.PngCompression, opt.Comment)
+			break
+		}
+		iw := &insertWriter{w: bw, at: pngIHDREnd, check: png_check_ihdr, insert: png_text_chunk("Comment", opt.Comment)}
+		enc := png.Encoder{CompressionLevel: opt.PngCompression}
+		err = enc.Encode(iw, img)
+		if err == nil {
+			err = iw.Finish()
+		}
+	case "jpeg":
+		if opt.Progressive {
+			return errProgressiveJpeg
+		}
+		iw := &insertWriter{w: bw, at: 2, check: jpeg_check_soi, insert: jpeg_comment_segment(opt.Comment)}
+		err = jpeg.Encode(iw, img, &jpeg.Options{Quality: opt.JpegQuality})
+		if err == nil {
+			err = iw.Finish()
+		}
+	case "tiff":
+		bounds := img.Bounds()
+		if int64(bounds.Dx())*int64(bounds.Dy())*4 >= 1<<32-1<<20 {
+			// classic tiff offsets are 32 bits
+			err = encode_bigtiff(bw, img, opt.Comment)
+		} else {
+			tw := &tiffDescriptionWriter{w: bw, description: opt.Comment}
+			err = tiff.Encode(tw, img, &tiff.Options{Compression: tiff.Deflate})
+			if err == nil {
+				err = tw.Finish()
+			}
+		}
+	case "bmp":
+		err = bmp.Encode(bw, img)
+	case "webp":
+		err = encode_webp(bw, img, opt.Comment)
+	default:
+		return errors.New("unknown target type")
+	}
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// errProgressiveJpeg is returned for a progressive jpg target, image/jpeg only writes baseline jpg
+var errProgressiveJpeg = errors.New("progressive jpeg not supported by image/jpeg")
+
+// insertWriter passes the first at bytes written to it on to w, checked by check, then writes insert, then the rest,
+// so metadata can go in the head of an encoded stream without holding the whole stream
+type insertWriter struct {
+	w      io.Writer
+	at     int
+	check  func(head []byte) error
+	insert []byte
+	head   []byte
+	done   bool
+}
+
+func (iw *insertWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if !iw.done {
+		need := iw.at - len(iw.head)
+		if len(p) < need {
+			iw.head = append(iw.head, p...)
+			return n, nil
+		}
+		iw.head = append(iw.head, p[:need]...)
+		p = p[need:]
+
+		err := iw.check(iw.head)
+		if err != nil {
+			return 0, err
+		}
+		if _, err = iw.w.Write(iw.head); err != nil {
+			return 0, err
+		}
+		if _, err = iw.w.Write(iw.insert); err != nil {
+			return 0, err
+		}
+		iw.done = true
+	}
+	if len(p) > 0 {
+		if _, err := iw.w.Write(p); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// Finish fails when the stream ended before insert could be written
+func (iw *insertWriter) Finish() error {
+	if !iw.done {
+		return errors.New("encoded stream too short")
+	}
+	return nil
+}
+
+// pngIHDREnd is where the IHDR chunk of a png ends: signature, then IHDR length, type, 13 bytes, crc
+const pngIHDREnd = 8 + 4 + 4 + 13 + 4
+
+func png_check_ihdr(head []byte) error {
+	if len(head) < pngIHDREnd || string(head[12:16]) != "IHDR" {
+		return errors.New("bad png")
+	}
+	return nil
+}
+
+// png_chunk returns a png chunk of type typ holding body
+func png_chunk(typ string, body []byte) []byte {
+	chunk := make([]byte, 8, 12+len(body))
+	binary.BigEndian.PutUint32(chunk, uint32(len(body)))
+	copy(chunk[4:], typ)
+	chunk = append(chunk, body...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	return append(chunk, crc...)
+}
+
+// png_text_chunk returns a tEXt chunk, it goes right after the IHDR chunk
+func png_text_chunk(keyword string, text string) []byte {
+	return png_chunk("tEXt", append([]byte(keyword+"\x00"), text...))
+}
+
+func jpeg_check_soi(head []byte) error {
+	if len(head) < 2 || head[0] != 0xff || head[1] != 0xd8 {
+		return errors.New("bad jpeg")
+	}
+	return nil
+}
+
+// jpeg_comment_segment returns a COM segment, it goes right after the SOI marker
+func jpeg_comment_segment(comment string) []byte {
+	if len(comment) > 0xffff-2 {
+		comment = comment[:0xffff-2]
+	}
+	segment := []byte{0xff, 0xfe, byte((len(comment) + 2) >> 8), byte(len(comment) + 2)}
+	return append(segment, comment...)
+}
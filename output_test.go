@@ -0,0 +1,195 @@
+package mosaic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"golang.org/x/image/tiff"
+)
+
+func TestEncodeTargetComment(t *testing.T) {
+	img := test_src(7, 5)
+	opt := EncodeOption{JpegQuality: 90, PngCompression: png.DefaultCompression, Comment: "go-mosaic seed=42"}
+
+	var plainpng, plainjpeg bytes.Buffer
+	if err := png.Encode(&plainpng, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := jpeg.Encode(&plainjpeg, img, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		format string
+		plain  []byte
+		at     int
+		insert []byte
+	}{
+		{"png", plainpng.Bytes(), pngIHDREnd, png_text_chunk("Comment", opt.Comment)},
+		{"jpeg", plainjpeg.Bytes(), 2, jpeg_comment_segment(opt.Comment)},
+	} {
+		var b bytes.Buffer
+		if err := encode_target(&b, img, tt.format, opt); err != nil {
+			t.Fatalf("%s: %s", tt.format, err)
+		}
+
+		want := append(append(append([]byte{}, tt.plain[:tt.at]...), tt.insert...), tt.plain[tt.at:]...)
+		if !bytes.Equal(b.Bytes(), want) {
+			t.Fatalf("%s: comment not right after the header", tt.format)
+		}
+		if _, _, err := image.Decode(bytes.NewReader(b.Bytes())); err != nil {
+			t.Fatalf("%s: decode %s", tt.format, err)
+		}
+	}
+}
+
+func TestInsertWriter(t *testing.T) {
+	var b bytes.Buffer
+	iw := &insertWriter{w: &b, at: 4, check: func([]byte) error { return nil }, insert: []byte("--")}
+
+	// the head may come in any number of writes
+	for _, s := range []string{"ab", "c", "defg", "", "h"} {
+		if _, err := iw.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := iw.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "abcd--efgh" {
+		t.Fatalf("got %q", b.String())
+	}
+
+	short := &insertWriter{w: &b, at: 4, check: func([]byte) error { return nil }}
+	short.Write([]byte("abc"))
+	if short.Finish() == nil {
+		t.Fatalf("Finish of a short stream did not fail")
+	}
+}
+
+// tiffField is an IFD entry read back by read_tiff_ifd
+type tiffField struct {
+	typ   uint16
+	count uint64
+	data  []byte
+}
+
+// read_tiff_ifd reads the first IFD of a little endian tiff or BigTIFF, failing on any offset out of data
+func read_tiff_ifd(t *testing.T, data []byte) map[uint16]tiffField {
+	le := binary.LittleEndian
+	if len(data) < 16 || string(data[:2]) != "II" {
+		t.Fatalf("no little endian tiff")
+	}
+	big := le.Uint16(data[2:]) == 43
+	var ifd, entrysize, inline uint64 = uint64(le.Uint32(data[4:])), 12, 4
+	if big {
+		if le.Uint16(data[4:]) != 8 {
+			t.Fatalf("bigtiff offset size %d", le.Uint16(data[4:]))
+		}
+		ifd, entrysize, inline = le.Uint64(data[8:]), 20, 8
+	}
+	if ifd+8 > uint64(len(data)) {
+		t.Fatalf("ifd offset %d of %d", ifd, len(data))
+	}
+
+	var n uint64
+	var entries uint64
+	if big {
+		n, entries = le.Uint64(data[ifd:]), ifd+8
+	} else {
+		n, entries = uint64(le.Uint16(data[ifd:])), ifd+2
+	}
+	if entries+n*entrysize+inline > uint64(len(data)) {
+		t.Fatalf("ifd of %d entries past end", n)
+	}
+
+	fields := map[uint16]tiffField{}
+	last := -1
+	for i := uint64(0); i < n; i++ {
+		e := data[entries+i*entrysize:]
+		tag, typ := le.Uint16(e), le.Uint16(e[2:])
+		if int(tag) <= last {
+			t.Fatalf("tag %d out of order", tag)
+		}
+		last = int(tag)
+
+		var count, value uint64
+		if big {
+			count, value = le.Uint64(e[4:]), 12
+		} else {
+			count, value = uint64(le.Uint32(e[4:])), 8
+		}
+		size := uint64(tiffTypeSize[typ])
+		if typ == 16 {
+			size = 8
+		}
+		if size == 0 {
+			t.Fatalf("tag %d type %d", tag, typ)
+		}
+		length := size * count
+		var field []byte
+		if length <= inline {
+			field = e[value : value+length]
+		} else {
+			offset := uint64(le.Uint32(e[value:]))
+			if big {
+				offset = le.Uint64(e[value:])
+			}
+			if offset+length > uint64(len(data)) {
+				t.Fatalf("tag %d values past end", tag)
+			}
+			field = data[offset : offset+length]
+		}
+		fields[tag] = tiffField{typ, count, field}
+	}
+	return fields
+}
+
+func TestEncodeTiffDescription(t *testing.T) {
+	img := test_src(7, 5).(*image.RGBA)
+	var plain bytes.Buffer
+	if err := tiff.Encode(&plain, img, &tiff.Options{Compression: tiff.Deflate}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, comment := range []string{"go-mosaic seed=42", "abc", ""} {
+		var b bytes.Buffer
+		if err := encode_target(&b, img, "tiff", EncodeOption{Comment: comment}); err != nil {
+			t.Fatal(err)
+		}
+		ifd := binary.LittleEndian.Uint32(plain.Bytes()[4:])
+		if !bytes.Equal(b.Bytes()[:ifd], plain.Bytes()[:ifd]) {
+			t.Fatalf("%q: pixels changed", comment)
+		}
+
+		fields := read_tiff_ifd(t, b.Bytes())
+		if f := fields[270]; f.typ != 2 || string(f.data) != comment+"\x00" {
+			t.Fatalf("%q: description %+v", comment, f)
+		}
+		plainfields := read_tiff_ifd(t, plain.Bytes())
+		for tag, f := range plainfields {
+			if g := fields[tag]; g.typ != f.typ || g.count != f.count || !bytes.Equal(g.data, f.data) {
+				t.Fatalf("%q: tag %d %+v want %+v", comment, tag, g, f)
+			}
+		}
+
+		dec, err := tiff.Decode(bytes.NewReader(b.Bytes()))
+		if err != nil {
+			t.Fatalf("%q: %s", comment, err)
+		}
+		if !bytes.Equal(dec.(*image.RGBA).Pix, img.Pix) {
+			t.Fatalf("%q: decoded pixels differ", comment)
+		}
+	}
+
+	var b bytes.Buffer
+	tw := &tiffDescriptionWriter{w: &b, description: "x"}
+	tw.Write(plain.Bytes()[:20])
+	if tw.Finish() == nil {
+		t.Fatalf("Finish of a short tiff did not fail")
+	}
+}
@@ -0,0 +1,194 @@
+package mosaic
+
+import (
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// adam7Passes are the first pixel and the step of each of the 7 passes of an interlaced png
+var adam7Passes = [7]struct{ x, y, dx, dy int }{
+	{0, 0, 8, 8}, {4, 0, 8, 8}, {0, 4, 4, 8}, {2, 0, 4, 4}, {0, 2, 2, 4}, {1, 0, 2, 2}, {0, 1, 1, 2},
+}
+
+// pngIDATSize is the most data put in one IDAT chunk
+const pngIDATSize = 1 << 16
+
+// encode_png_interlaced writes img as an Adam7 interlaced png, which image/png can not write, so a browser shows
+// the whole target coarse first, comment goes in a tEXt chunk right after the IHDR chunk as encode_target does
+func encode_png_interlaced(w io.Writer, img image.Image, level png.CompressionLevel, comment string) error {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+	if width <= 0 || height <= 0 || int64(width) >= 1<<31 || int64(height) >= 1<<31 {
+		return errors.New("png size error")
+	}
+
+	// opaque pics are written as RGB, the rest as RGBA
+	bpp := 4
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr, uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(height))
+	ihdr[8] = 8
+	ihdr[9] = 6
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		bpp = 3
+		ihdr[9] = 2
+	}
+	ihdr[12] = 1
+
+	head := append([]byte("\x89PNG\r\n\x1a\n"), png_chunk("IHDR", ihdr)...)
+	head = append(head, png_text_chunk("Comment", comment)...)
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+
+	cw := &pngIDATWriter{w: w}
+	zw, err := zlib.NewWriterLevel(cw, zlib_level(level))
+	if err != nil {
+		return err
+	}
+
+	rgba, _ := img.(*image.RGBA)
+	row := make([]byte, width*bpp)
+	prev := make([]byte, width*bpp)
+	var filtered [5][]byte
+	for i := range filtered {
+		filtered[i] = make([]byte, 1+width*bpp)
+	}
+	for _, pass := range adam7Passes {
+		passw := (width - pass.x + pass.dx - 1) / pass.dx
+		if passw <= 0 || pass.y >= height {
+			continue
+		}
+		rowlen := passw * bpp
+		for i := range prev[:rowlen] {
+			prev[i] = 0
+		}
+
+		for y := pass.y; y < height; y += pass.dy {
+			i := 0
+			for x := pass.x; x < width; x += pass.dx {
+				if rgba != nil && bpp == 3 {
+					// opaque, so not premultiplied
+					p := rgba.PixOffset(bounds.Min.X+x, bounds.Min.Y+y)
+					copy(row[i:i+3], rgba.Pix[p:p+3])
+				} else {
+					c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+					copy(row[i:i+bpp], []byte{c.R, c.G, c.B, c.A})
+				}
+				i += bpp
+			}
+
+			if _, err := zw.Write(png_filter_row(&filtered, row[:rowlen], prev[:rowlen], bpp)); err != nil {
+				return err
+			}
+			row, prev = prev, row
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := cw.flush(); err != nil {
+		return err
+	}
+	_, err = w.Write(png_chunk("IEND", nil))
+	return err
+}
+
+// png_filter_row returns row filtered with the one of the 5 png filters that gives the smallest sum of
+// absolute differences, as image/png picks them, led by the filter type
+func png_filter_row(filtered *[5][]byte, row []byte, prev []byte, bpp int) []byte {
+	best := 0
+	bestsum := -1
+	for f := 0; f < 5; f++ {
+		out := filtered[f][:1+len(row)]
+		out[0] = byte(f)
+		sum := 0
+		for i, v := range row {
+			var a, b, c byte
+			if i >= bpp {
+				a, c = row[i-bpp], prev[i-bpp]
+			}
+			b = prev[i]
+			switch f {
+			case 1:
+				v -= a
+			case 2:
+				v -= b
+			case 3:
+				v -= byte((int(a) + int(b)) / 2)
+			case 4:
+				v -= paeth(a, b, c)
+			}
+			out[1+i] = v
+			sum += absInt(int(int8(v)))
+			if bestsum >= 0 && sum >= bestsum {
+				break
+			}
+		}
+		if bestsum < 0 || sum < bestsum {
+			best, bestsum = f, sum
+		}
+	}
+	return filtered[best][:1+len(row)]
+}
+
+// paeth is the png Paeth predictor of a pixel byte from its left, up and up left neighbours
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := absInt(p-int(a)), absInt(p-int(b)), absInt(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func zlib_level(level png.CompressionLevel) int {
+	switch level {
+	case png.NoCompression:
+		return zlib.NoCompression
+	case png.BestSpeed:
+		return zlib.BestSpeed
+	case png.BestCompression:
+		return zlib.BestCompression
+	}
+	return zlib.DefaultCompression
+}
+
+// pngIDATWriter cuts the zlib stream written to it into IDAT chunks
+type pngIDATWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (cw *pngIDATWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		m := minInt(len(p), pngIDATSize-len(cw.buf))
+		cw.buf = append(cw.buf, p[:m]...)
+		p = p[m:]
+		if len(cw.buf) == pngIDATSize {
+			if err := cw.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (cw *pngIDATWriter) flush() error {
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	_, err := cw.w.Write(png_chunk("IDAT", cw.buf))
+	cw.buf = cw.buf[:0]
+	return err
+}
@@ -0,0 +1,105 @@
+package mosaic
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"testing"
+
+	"github.com/chyroc/go-ptr"
+)
+
+func TestEncodePngInterlaced(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	noise := func(w, h int) *image.NRGBA {
+		img := image.NewNRGBA(image.Rect(0, 0, w, h))
+		rnd.Read(img.Pix)
+		return img
+	}
+	opaque := test_src(300, 250).(*image.RGBA)
+	rnd.Read(opaque.Pix[:len(opaque.Pix)/2])
+	for i := 3; i < len(opaque.Pix); i += 4 {
+		opaque.Pix[i] = 255
+	}
+
+	for _, tt := range []struct {
+		name  string
+		img   image.Image
+		level png.CompressionLevel
+	}{
+		// smaller than a pass grid, so some passes are empty
+		{"1x1", noise(1, 1), png.DefaultCompression},
+		{"3x5", noise(3, 5), png.BestSpeed},
+		{"9x9", test_src(9, 9), png.BestCompression},
+		{"17x13 alpha", noise(17, 13), png.DefaultCompression},
+		// no compression puts the noise in many IDAT chunks
+		{"300x250 opaque", opaque, png.NoCompression},
+		{"offset bounds", opaque.SubImage(image.Rect(7, 3, 30, 21)), png.DefaultCompression},
+	} {
+		var b bytes.Buffer
+		if err := encode_png_interlaced(&b, tt.img, tt.level, "go-mosaic seed=42"); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		data := b.Bytes()
+
+		var types []string
+		for p := 8; p < len(data); {
+			n := int(binary.BigEndian.Uint32(data[p:]))
+			types = append(types, string(data[p+4:p+8]))
+			p += 12 + n
+		}
+		if len(types) < 4 || types[0] != "IHDR" || types[1] != "tEXt" || types[len(types)-1] != "IEND" {
+			t.Fatalf("%s: chunks %v", tt.name, types)
+		}
+		if data[8+8+12] != 1 {
+			t.Fatalf("%s: not interlaced", tt.name)
+		}
+		if tt.level == png.NoCompression && len(types) < 6 {
+			t.Fatalf("%s: chunks %v, want the data in more IDAT chunks", tt.name, types)
+		}
+
+		dec, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: decode %s", tt.name, err)
+		}
+		bounds := tt.img.Bounds()
+		if dec.Bounds().Size() != bounds.Size() {
+			t.Fatalf("%s: size %v", tt.name, dec.Bounds())
+		}
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				want := color.NRGBAModel.Convert(tt.img.At(bounds.Min.X+x, bounds.Min.Y+y))
+				if got := color.NRGBAModel.Convert(dec.At(x, y)); got != want {
+					t.Fatalf("%s: pixel %d,%d %v want %v", tt.name, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestProgressive(t *testing.T) {
+	img := test_src(20, 10)
+	var plain, progressive bytes.Buffer
+	if err := encode_target(&plain, img, "png", EncodeOption{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := encode_target(&progressive, img, "png", EncodeOption{Progressive: true}); err != nil {
+		t.Fatal(err)
+	}
+	if plain.Bytes()[28] != 0 || progressive.Bytes()[28] != 1 {
+		t.Fatalf("interlace %d %d", plain.Bytes()[28], progressive.Bytes()[28])
+	}
+
+	if err := encode_target(&bytes.Buffer{}, img, "jpeg", EncodeOption{JpegQuality: 90, Progressive: true}); err != errProgressiveJpeg {
+		t.Fatalf("progressive jpeg err %v", err)
+	}
+	// the render fails before any lib is read
+	req := &Request{SrcImage: img, Lib: t.TempDir(), Progressive: ptr.Bool(true)}
+	if err := MosaicWriter(context.Background(), req, &bytes.Buffer{}, "jpeg"); err != errProgressiveJpeg {
+		t.Fatalf("MosaicWriter progressive jpeg err %v", err)
+	}
+}
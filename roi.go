@@ -0,0 +1,145 @@
+package mosaic
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"sync/atomic"
+
+	"golang.org/x/image/draw"
+)
+
+// load_weight returns the weight of every part of a src of srcsize, the mask in maskpath with the rects painted
+// white over it, nil when there is neither
+func load_weight(srcsize image.Point, maskpath string, rects []image.Rectangle) (image.Image, error) {
+	if maskpath == "" && len(rects) == 0 {
+		return nil, nil
+	}
+
+	var mask image.Image
+	if maskpath != "" {
+		reader, err := os.Open(maskpath)
+		if err != nil {
+			log.Printf("load_weight Open fail %s %s", maskpath, err)
+			return nil, err
+		}
+		defer reader.Close()
+
+		mask, _, err = decode_img(reader)
+		if err != nil {
+			log.Printf("load_weight Decode fail %s %s", maskpath, err)
+			return nil, err
+		}
+		if len(rects) == 0 {
+			return mask, nil
+		}
+	}
+
+	weight := image.NewGray(image.Rectangle{Max: srcsize})
+	if mask != nil {
+		draw.ApproxBiLinear.Scale(weight, weight.Bounds(), mask, mask.Bounds(), draw.Src, nil)
+	}
+	for _, rect := range rects {
+		draw.Draw(weight, rect, image.White, image.Point{}, draw.Src)
+	}
+
+	log.Printf("load_weight ok %s %d rects", maskpath, len(rects))
+	return weight, nil
+}
+
+// weightCandidates is how many of the tiles nearest in color a weighted cell picks from, so the lib is looked
+// through once per cell color, as match_cell does, and not once per cell
+const weightCandidates = 64
+
+// weight_cells matches the cells from the highest weight down before rendering, every tile gets reusepenalty
+// added to its color distance each time it has been used as often as a tile is on avg, so the important cells
+// get the best fitting fresh tiles and the background takes what is left of the weightCandidates nearest tiles
+func weight_cells(ctx context.Context, cells []Cell, weight image.Image, size image.Point, masks *MaskCache, fis []FileInfo, transforms []Transform, seed int64, reusepenalty float64, mc *MatchCache) error {
+	weights := make([]float64, len(cells))
+	order := make([]int, len(cells))
+	for i, cell := range cells {
+		c := shape_color(weight, size, cell.Rect, cell.Rect, masks.Get(cell))
+		weights[i] = (float64(c.R) + float64(c.G) + float64(c.B)) / 3
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return weights[order[i]] > weights[order[j]]
+	})
+
+	uses := make(map[string]int, len(fis))
+	avguse := math.Max(float64(len(cells))/float64(len(fis)), 1)
+
+	var done int32
+	stop := every_second(func() {
+		log.Printf("weight progress=%d/%d", atomic.LoadInt32(&done), len(cells))
+	})
+	defer stop()
+
+	ties := make([]FileInfo, 0, 16)
+	for _, i := range order {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		cell := &cells[i]
+
+		src := cell.C
+		candidates, _, err := mc.Do("nearest "+make_string(src.R, src.G, src.B), func() ([]FileInfo, error) {
+			return find_nearest(fis, src, weightCandidates), nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(candidates) <= 0 {
+			return errors.New("no pic")
+		}
+
+		best := math.MaxFloat64
+		ties = ties[:0]
+		for _, fi := range candidates {
+			diff := ColorDistance(src, color.RGBA{fi.R, fi.G, fi.B, 0}) + reusepenalty*float64(uses[fi.Filename])/avguse
+			if diff < best-1e-9 {
+				best = diff
+				ties = ties[:0]
+			}
+			if diff <= best+1e-9 {
+				ties = append(ties, fi)
+			}
+		}
+
+		fi, transform, _ := pick_tile(ties, *cell, transforms, cell_rand(seed, *cell))
+		uses[fi.Filename]++
+		cell.Match = &Match{FileInfo: fi, Transform: transform}
+		atomic.AddInt32(&done, 1)
+	}
+
+	log.Printf("weight ok %d", len(cells))
+	return nil
+}
+
+// find_nearest returns the n tiles of fis nearest in color to src, nearest first, the earlier ones first on ties
+func find_nearest(fis []FileInfo, src color.RGBA, n int) []FileInfo {
+	nearest := make([]FileInfo, 0, n+1)
+	diffs := make([]float64, 0, n+1)
+	for _, fi := range fis {
+		diff := ColorDistance(src, color.RGBA{fi.R, fi.G, fi.B, 0})
+		if len(nearest) == n && diff >= diffs[n-1] {
+			continue
+		}
+		i := sort.Search(len(diffs), func(i int) bool { return diffs[i] > diff })
+		nearest = append(nearest, FileInfo{})
+		copy(nearest[i+1:], nearest[i:])
+		nearest[i] = fi
+		diffs = append(diffs, 0)
+		copy(diffs[i+1:], diffs[i:])
+		diffs[i] = diff
+		if len(nearest) > n {
+			nearest, diffs = nearest[:n], diffs[:n]
+		}
+	}
+	return nearest
+}
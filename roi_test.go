@@ -0,0 +1,110 @@
+package mosaic
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestFindNearest(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var fis []FileInfo
+	for i := 0; i < 200; i++ {
+		// few colors, so there are ties
+		fis = append(fis, FileInfo{Filename: fmt.Sprint(i), R: uint8(rnd.Intn(4) * 60), G: uint8(rnd.Intn(4) * 60), B: 100})
+	}
+	src := color.RGBA{70, 130, 90, 255}
+
+	sorted := append([]FileInfo{}, fis...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return ColorDistance(src, color.RGBA{sorted[i].R, sorted[i].G, sorted[i].B, 0}) < ColorDistance(src, color.RGBA{sorted[j].R, sorted[j].G, sorted[j].B, 0})
+	})
+	for _, n := range []int{1, 7, 64, 200, 300} {
+		got := find_nearest(fis, src, n)
+		want := sorted[:minInt(n, len(sorted))]
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("n %d: got %v", n, got)
+		}
+	}
+}
+
+// weight_test_cells returns the cells of a flat w*h src, tiles 8*8, and a weight with its left column white
+func weight_test_cells(w, h int, left int) ([]Cell, image.Image, *MaskCache) {
+	gray := color.RGBA{100, 100, 100, 255}
+	var cells []Cell
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			cell := Cell{X: x, Y: y, Size: 1, C: gray, Grid: [4]color.RGBA{gray, gray, gray, gray}}
+			cell.Rect = cell_rect("Square", cell, 8, 8)
+			cells = append(cells, cell)
+		}
+	}
+	weight := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < left; x++ {
+			weight.Pix[weight.PixOffset(x, y)] = 255
+		}
+	}
+	return cells, weight, NewMaskCache("Square", 8, 8)
+}
+
+func TestWeightCells(t *testing.T) {
+	// tiles farther and farther from the gray of the src
+	lib := func(n int) []FileInfo {
+		var fis []FileInfo
+		for i := 0; i < n; i++ {
+			fis = append(fis, FileInfo{Filename: fmt.Sprintf("%03d", i), R: uint8(100 + i), G: 100, B: 100})
+		}
+		return fis
+	}
+	transforms := []Transform{TransformNone}
+
+	// 16 cells of weight, 48 without, 24 tiles
+	cells, weight, masks := weight_test_cells(8, 8, 2)
+	fis := lib(24)
+	if err := weight_cells(context.Background(), cells, weight, image.Pt(64, 64), masks, fis, transforms, 42, 1000, NewMatchCache()); err != nil {
+		t.Fatal(err)
+	}
+	high, low := map[string]int{}, map[string]int{}
+	for _, cell := range cells {
+		if cell.X < 2 {
+			high[cell.Match.FileInfo.Filename]++
+		} else {
+			low[cell.Match.FileInfo.Filename]++
+		}
+	}
+	// the weighted cells get the 16 nearest tiles, one each, the rest share what is left
+	for i := 0; i < 16; i++ {
+		if name := fmt.Sprintf("%03d", i); high[name] != 1 {
+			t.Fatalf("weighted cells use %s %d times", name, high[name])
+		}
+	}
+	if len(high) != 16 || len(low) > 24 {
+		t.Fatalf("%d tiles for the 16 weighted cells, %d for the 48 without weight", len(high), len(low))
+	}
+
+	// without weight every cell of the flat src takes the nearest tile
+	mc := NewMatchCache()
+	for _, cell := range cells[:16] {
+		fi, _, _, err := match_cell(cell, fis, transforms, 42, mc)
+		if err != nil || fi.Filename != "000" {
+			t.Fatalf("unweighted match %s %v", fi.Filename, err)
+		}
+	}
+
+	// only the weightCandidates nearest tiles are looked at, however often they are used
+	cells, weight, masks = weight_test_cells(16, 8, 2)
+	fis = lib(100)
+	if err := weight_cells(context.Background(), cells, weight, image.Pt(128, 64), masks, fis, transforms, 42, 1000, NewMatchCache()); err != nil {
+		t.Fatal(err)
+	}
+	for _, cell := range cells {
+		if name := cell.Match.FileInfo.Filename; name >= fmt.Sprintf("%03d", weightCandidates) {
+			t.Fatalf("cell %d,%d took %s", cell.X, cell.Y, name)
+		}
+	}
+}
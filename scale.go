@@ -0,0 +1,127 @@
+package mosaic
+
+import (
+	"image"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+// areaScaler averages every src pixel a dst pixel covers, weighted by how much of it is covered,
+// so small details still add to the color when scaling down a lot, scaling up falls back to CatmullRom
+type areaScaler struct{}
+
+var areaScale draw.Scaler = areaScaler{}
+
+type areaWeight struct {
+	i int
+	w float64
+}
+
+func (areaScaler) Scale(dst draw.Image, dr image.Rectangle, src image.Image, sr image.Rectangle, op draw.Op, opts *draw.Options) {
+	if dr.Empty() || sr.Empty() {
+		return
+	}
+	if dr.Dx() >= sr.Dx() && dr.Dy() >= sr.Dy() {
+		draw.CatmullRom.Scale(dst, dr, src, sr, op, opts)
+		return
+	}
+
+	s := to_rgba(src, sr)
+	xw := area_weights(sr.Dx(), dr.Dx())
+	yw := area_weights(sr.Dy(), dr.Dy())
+
+	tmp := image.NewRGBA(image.Rect(0, 0, dr.Dx(), dr.Dy()))
+	for y, ys := range yw {
+		for x, xs := range xw {
+			var sum [4]float64
+			var weight float64
+			for _, wy := range ys {
+				for _, wx := range xs {
+					w := wy.w * wx.w
+					i := s.PixOffset(wx.i, wy.i)
+					for c := 0; c < 4; c++ {
+						sum[c] += float64(s.Pix[i+c]) * w
+					}
+					weight += w
+				}
+			}
+			i := tmp.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				tmp.Pix[i+c] = uint8(math.Min(255, math.Round(sum[c]/weight)))
+			}
+		}
+	}
+
+	draw.Draw(dst, dr, tmp, image.Point{}, op)
+}
+
+// area_weights returns for every one of m dst pixels the src pixels of n it covers and by how much
+func area_weights(n int, m int) [][]areaWeight {
+	ratio := float64(n) / float64(m)
+	weights := make([][]areaWeight, m)
+	for i := range weights {
+		start := float64(i) * ratio
+		end := float64(i+1) * ratio
+		for j := int(start); j < n && float64(j) < end; j++ {
+			w := math.Min(end, float64(j+1)) - math.Max(start, float64(j))
+			if w > 1e-9 {
+				weights[i] = append(weights[i], areaWeight{j, w})
+			}
+		}
+	}
+	return weights
+}
+
+// to_rgba returns the part r of src as an RGBA starting at 0, 0
+func to_rgba(src image.Image, r image.Rectangle) *image.RGBA {
+	if rgba, ok := src.(*image.RGBA); ok && r.Min == (image.Point{}) {
+		return rgba
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, r.Min, draw.Src)
+	return dst
+}
+
+// enhance stretches the colors of img away from their mean luminance by contrast, then adds sharpen times
+// the difference to a blurred copy (unsharp mask), so small features stand out before the cells are matched
+func enhance(img *image.RGBA, sharpen float64, contrast float64) {
+	if contrast != 1 {
+		bounds := img.Bounds()
+		var mean, count float64
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := img.RGBAAt(x, y)
+				mean += 0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)
+				count++
+			}
+		}
+		mean /= count
+
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			i := img.PixOffset(bounds.Min.X, y)
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				for c := 0; c < 3; c++ {
+					img.Pix[i+c] = clamp_uint8((float64(img.Pix[i+c])-mean)*contrast + mean)
+				}
+				i += 4
+			}
+		}
+	}
+
+	if sharpen > 0 {
+		blurred := image.NewRGBA(img.Bounds())
+		copy(blurred.Pix, img.Pix)
+		box_blur(blurred, 1)
+		for i := range img.Pix {
+			if i%4 == 3 {
+				continue
+			}
+			img.Pix[i] = clamp_uint8(float64(img.Pix[i]) + sharpen*(float64(img.Pix[i])-float64(blurred.Pix[i])))
+		}
+	}
+}
+
+func clamp_uint8(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Round(v))))
+}
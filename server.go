@@ -0,0 +1,587 @@
+package mosaic
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chyroc/go-ptr"
+)
+
+// serverMaxUpload is the biggest src that can be uploaded, in bytes
+const serverMaxUpload = 256 << 20
+
+// serverMaxFinished is how many finished jobs are kept at most, the ones that finished first are forgotten first
+const serverMaxFinished = 1000
+
+// Server is an http.Handler that indexes libs and renders srcs as jobs, the jobs run one after another since they
+// share one database, which bolt lets only one of them open at a time, and each one uses the Worker threads of its req,
+// finished jobs with their targets and srcs no job waits for are deleted once they are older than keep
+//
+//	POST   /srcs              upload a src pic, as the body or the multipart field "file", returns its id
+//	GET    /srcs              ids of the uploaded srcs
+//	DELETE /srcs/{id}         delete an uploaded src, 409 while a job waits for it
+//	GET    /libs              names of the libs jobs can use
+//	POST   /jobs              queue a job, a JobRequest as json, 503 when the queue is full
+//	GET    /jobs              all jobs
+//	GET    /jobs/{id}         state and progress of a job
+//	GET    /jobs/{id}/result  target of a done render job
+//	DELETE /jobs/{id}         cancel a job, or forget a finished one and delete its target
+//	GET    /metrics           MetricsHandler metrics and the number of jobs in each state
+type Server struct {
+	ctx   context.Context
+	req   *Request          // options of every job
+	libs  map[string]string // lib path by lib name
+	dir   string            // uploaded srcs and targets are kept in dir
+	keep  time.Duration     // how long finished jobs and srcs are kept, 0 keeps them until they are deleted
+	queue chan *Job
+
+	lock sync.Mutex
+	jobs map[string]*Job
+}
+
+// JobRequest is what a job does, it renders the uploaded src Src with the lib LibName, or only indexes the lib
+type JobRequest struct {
+	Src       string  `json:"src"`
+	LibName   string  `json:"lib_name"`
+	Index     bool    `json:"index"`
+	Format    string  `json:"format"` // png/jpeg/tiff/bmp/webp, default png
+	PixelSize *int    `json:"pixel_size"`
+	SrcSize   *int    `json:"src_size"`
+	Layout    *string `json:"layout"`
+	Transform *string `json:"transform"`
+	Seed      *int64  `json:"seed"`
+}
+
+// Job is a job of a Server
+type Job struct {
+	ID       string     `json:"id"`
+	Request  JobRequest `json:"request"`
+	State    string     `json:"state"` // queued/running/done/failed/canceled
+	Stage    string     `json:"stage"` // index/draw, as Request.Progress says
+	Done     int        `json:"done"`
+	Total    int        `json:"total"`
+	TileHit  int64      `json:"tile_hit"`  // tile cache hits of a render, as Request.TileStat says
+	TileMiss int64      `json:"tile_miss"` // tile cache misses of a render
+	Error    string     `json:"error,omitempty"`
+
+	target   string
+	finished time.Time
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// NewServer returns a Server running jobs with the options of req against the libs, until ctx is done,
+// at most queue jobs wait to run, finished jobs and srcs are kept for keep
+func NewServer(ctx context.Context, req *Request, libs map[string]string, dir string, queue int, keep time.Duration) (*Server, error) {
+	for _, sub := range []string{"srcs", "targets"} {
+		err := os.MkdirAll(filepath.Join(dir, sub), 0o755)
+		if err != nil {
+			log.Printf("NewServer MkdirAll fail %s %s", dir, err)
+			return nil, err
+		}
+	}
+
+	s := &Server{ctx: ctx, req: req, libs: libs, dir: dir, keep: keep, queue: make(chan *Job, queue), jobs: make(map[string]*Job)}
+	go s.run()
+	go s.clean_every(clean_interval(keep))
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "srcs" && r.Method == http.MethodPost:
+		s.upload_src(w, r)
+	case len(parts) == 1 && parts[0] == "srcs" && r.Method == http.MethodGet:
+		s.list_srcs(w)
+	case len(parts) == 2 && parts[0] == "srcs" && r.Method == http.MethodDelete:
+		s.delete_src(w, parts[1])
+	case len(parts) == 1 && parts[0] == "libs" && r.Method == http.MethodGet:
+		names := make([]string, 0, len(s.libs))
+		for name := range s.libs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		write_json(w, http.StatusOK, names)
+	case len(parts) == 1 && parts[0] == "jobs" && r.Method == http.MethodPost:
+		s.start_job(w, r)
+	case len(parts) == 1 && parts[0] == "jobs" && r.Method == http.MethodGet:
+		s.list_jobs(w)
+	case len(parts) == 2 && parts[0] == "jobs" && r.Method == http.MethodGet:
+		job, ok := s.get_job(parts[1])
+		if !ok {
+			write_error(w, http.StatusNotFound, "no job")
+			return
+		}
+		write_json(w, http.StatusOK, job)
+	case len(parts) == 2 && parts[0] == "jobs" && r.Method == http.MethodDelete:
+		s.cancel_job(w, parts[1])
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "result" && r.Method == http.MethodGet:
+		s.job_result(w, r, parts[1])
+	case len(parts) == 1 && parts[0] == "metrics" && r.Method == http.MethodGet:
+		s.metrics(w)
+	default:
+		write_error(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (s *Server) upload_src(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, serverMaxUpload)
+
+	var reader io.Reader = r.Body
+	mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediatype == "multipart/form-data" {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			write_error(w, http.StatusBadRequest, "no file: "+err.Error())
+			return
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	id := new_id()
+	filename := filepath.Join(s.dir, "srcs", id)
+	err := save_src(filename, reader)
+	if err != nil {
+		os.Remove(filename)
+		log.Printf("upload_src fail %s %s", id, err)
+		write_error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	log.Printf("upload_src ok %s", id)
+	write_json(w, http.StatusCreated, map[string]string{"id": id})
+}
+
+// save_src writes the src in r to filename, it fails unless the src is a pic that can be decoded
+func save_src(filename string, r io.Reader) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, r)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, _, err = image.DecodeConfig(file)
+	if err != nil {
+		return errors.New("src is no pic: " + err.Error())
+	}
+	return file.Close()
+}
+
+func (s *Server) list_srcs(w http.ResponseWriter) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, "srcs"))
+	if err != nil {
+		write_error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if isID(e.Name()) {
+			ids = append(ids, e.Name())
+		}
+	}
+	write_json(w, http.StatusOK, ids)
+}
+
+func (s *Server) delete_src(w http.ResponseWriter, id string) {
+	if !isID(id) {
+		write_error(w, http.StatusNotFound, "no src")
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.src_in_use(id) {
+		write_error(w, http.StatusConflict, "a job waits for the src")
+		return
+	}
+	err := os.Remove(filepath.Join(s.dir, "srcs", id))
+	if os.IsNotExist(err) {
+		write_error(w, http.StatusNotFound, "no src")
+		return
+	}
+	if err != nil {
+		write_error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Printf("delete_src ok %s", id)
+	write_json(w, http.StatusOK, map[string]string{"id": id})
+}
+
+// src_in_use reports whether a queued or running job renders the src id, s.lock is held
+func (s *Server) src_in_use(id string) bool {
+	for _, job := range s.jobs {
+		if !job.Request.Index && job.Request.Src == id && (job.State == "queued" || job.State == "running") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) start_job(w http.ResponseWriter, r *http.Request) {
+	var jr JobRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&jr)
+	if err != nil {
+		write_error(w, http.StatusBadRequest, "json error: "+err.Error())
+		return
+	}
+
+	if _, ok := s.libs[jr.LibName]; !ok {
+		write_error(w, http.StatusBadRequest, "no lib "+jr.LibName)
+		return
+	}
+	if jr.Format == "" {
+		jr.Format = "png"
+	}
+	if !isFormat(jr.Format) {
+		write_error(w, http.StatusBadRequest, "format type error, png/jpeg/tiff/bmp/webp")
+		return
+	}
+	if !jr.Index && !isID(jr.Src) {
+		write_error(w, http.StatusBadRequest, "no src "+jr.Src)
+		return
+	}
+
+	job := &Job{ID: new_id(), Request: jr, State: "queued"}
+	job.target = filepath.Join(s.dir, "targets", job.ID+format_ext(jr.Format))
+	job.ctx, job.cancel = context.WithCancel(s.ctx)
+
+	s.lock.Lock()
+	// checked under the lock, so the src is not deleted before the job is queued
+	if _, err := os.Stat(filepath.Join(s.dir, "srcs", jr.Src)); !jr.Index && err != nil {
+		s.lock.Unlock()
+		job.cancel()
+		write_error(w, http.StatusBadRequest, "no src "+jr.Src)
+		return
+	}
+	select {
+	case s.queue <- job:
+		s.jobs[job.ID] = job
+	default:
+		s.lock.Unlock()
+		job.cancel()
+		write_error(w, http.StatusServiceUnavailable, "queue full")
+		return
+	}
+	snapshot := *job
+	s.lock.Unlock()
+
+	log.Printf("start_job ok %s lib %s src %s index %v", job.ID, jr.LibName, jr.Src, jr.Index)
+	write_json(w, http.StatusAccepted, &snapshot)
+}
+
+func (s *Server) list_jobs(w http.ResponseWriter) {
+	s.lock.Lock()
+	jobs := make([]Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, *job)
+	}
+	s.lock.Unlock()
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	write_json(w, http.StatusOK, jobs)
+}
+
+// get_job returns a copy of the job id, taken under the lock
+func (s *Server) get_job(id string) (Job, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+func (s *Server) cancel_job(w http.ResponseWriter, id string) {
+	s.lock.Lock()
+	job, ok := s.jobs[id]
+	if !ok {
+		s.lock.Unlock()
+		write_error(w, http.StatusNotFound, "no job")
+		return
+	}
+	switch job.State {
+	case "queued":
+		job.State = "canceled"
+		job.finished = time.Now()
+		job.cancel()
+	case "running":
+		// the job turns canceled once it stops
+		job.cancel()
+	default:
+		delete(s.jobs, id)
+		os.Remove(job.target)
+	}
+	snapshot := *job
+	s.lock.Unlock()
+
+	log.Printf("cancel_job ok %s %s", id, snapshot.State)
+	write_json(w, http.StatusOK, &snapshot)
+}
+
+func (s *Server) job_result(w http.ResponseWriter, r *http.Request, id string) {
+	job, ok := s.get_job(id)
+	if !ok {
+		write_error(w, http.StatusNotFound, "no job")
+		return
+	}
+	if job.State != "done" || job.Request.Index {
+		write_error(w, http.StatusConflict, "no result, job is "+job.State)
+		return
+	}
+
+	file, err := os.Open(job.target)
+	if err != nil {
+		write_error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		write_error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	name := filepath.Base(job.target)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	http.ServeContent(w, r, name, fi.ModTime(), file)
+}
+
+func (s *Server) metrics(w http.ResponseWriter) {
+	states := map[string]int{"queued": 0, "running": 0, "done": 0, "failed": 0, "canceled": 0}
+	s.lock.Lock()
+	for _, job := range s.jobs {
+		states[job.State]++
+	}
+	s.lock.Unlock()
+
+	var b bytes.Buffer
+	write_metrics(&b)
+	b.WriteString("# HELP mosaic_jobs Jobs of the server in each state.\n# TYPE mosaic_jobs gauge\n")
+	for _, state := range []string{"queued", "running", "done", "failed", "canceled"} {
+		fmt.Fprintf(&b, "mosaic_jobs{state=%q} %d\n", state, states[state])
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+func (s *Server) run() {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case job := <-s.queue:
+			s.run_job(job)
+		}
+	}
+}
+
+func (s *Server) run_job(job *Job) {
+	s.lock.Lock()
+	if job.State != "queued" {
+		s.lock.Unlock()
+		return
+	}
+	job.State = "running"
+	s.lock.Unlock()
+
+	jr := job.Request
+	req := *s.req
+	req.Lib = s.libs[jr.LibName]
+	req.LibName = ptr.String(jr.LibName)
+	req.Src = filepath.Join(s.dir, "srcs", jr.Src)
+	req.SrcImage = nil
+	req.SrcReader = nil
+	req.Target = job.target
+	req.Manifest = nil
+	req.FromManifest = nil
+	req.HTML = nil
+	if jr.PixelSize != nil {
+		req.PixelSize = jr.PixelSize
+		req.TileWidth = nil
+		req.TileHeight = nil
+	}
+	if jr.SrcSize != nil {
+		req.SrcSize = jr.SrcSize
+	}
+	if jr.Layout != nil {
+		req.Layout = jr.Layout
+	}
+	if jr.Transform != nil {
+		req.Transform = jr.Transform
+	}
+	if jr.Seed != nil {
+		req.Seed = jr.Seed
+	}
+	req.Progress = func(stage string, done int, total int) {
+		s.lock.Lock()
+		job.Stage, job.Done, job.Total = stage, done, total
+		s.lock.Unlock()
+	}
+	req.TileStat = func(stat TileCacheStat) {
+		s.lock.Lock()
+		job.TileHit, job.TileMiss = stat.Hit, stat.Miss
+		s.lock.Unlock()
+	}
+
+	log.Printf("run_job start %s", job.ID)
+	var err error
+	if jr.Index {
+		err = Index(job.ctx, &req)
+	} else {
+		err = MosaicContext(job.ctx, &req)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch {
+	case err == nil:
+		job.State = "done"
+	case job.ctx.Err() != nil:
+		job.State = "canceled"
+	default:
+		job.State = "failed"
+		job.Error = err.Error()
+	}
+	if job.State != "done" {
+		os.Remove(job.target)
+	}
+	job.finished = time.Now()
+	job.cancel()
+	log.Printf("run_job end %s %s %s", job.ID, job.State, job.Error)
+}
+
+// clean_interval is how often the jobs and srcs older than keep are looked for
+func clean_interval(keep time.Duration) time.Duration {
+	interval := keep / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	if interval > time.Hour {
+		interval = time.Hour
+	}
+	return interval
+}
+
+func (s *Server) clean_every(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.clean(now)
+		}
+	}
+}
+
+// clean forgets the jobs finished before now-keep, and the ones that finished first beyond serverMaxFinished,
+// and deletes their targets, the srcs no job waits for and the targets no job has, older than now-keep
+func (s *Server) clean(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var finished []*Job
+	for _, job := range s.jobs {
+		if !job.finished.IsZero() {
+			finished = append(finished, job)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].finished.Before(finished[j].finished) })
+	for i, job := range finished {
+		if (s.keep > 0 && now.Sub(job.finished) > s.keep) || len(finished)-i > serverMaxFinished {
+			delete(s.jobs, job.ID)
+			os.Remove(job.target)
+			log.Printf("clean job %s %s", job.ID, job.State)
+		}
+	}
+
+	if s.keep <= 0 {
+		return
+	}
+	targets := make(map[string]bool, len(s.jobs))
+	for _, job := range s.jobs {
+		targets[filepath.Base(job.target)] = true
+	}
+	for _, sub := range []string{"srcs", "targets"} {
+		entries, err := os.ReadDir(filepath.Join(s.dir, sub))
+		if err != nil {
+			log.Printf("clean ReadDir fail %s %s", sub, err)
+			continue
+		}
+		for _, e := range entries {
+			if (sub == "srcs" && s.src_in_use(e.Name())) || (sub == "targets" && targets[e.Name()]) {
+				continue
+			}
+			fi, err := e.Info()
+			if err != nil || now.Sub(fi.ModTime()) <= s.keep {
+				continue
+			}
+			os.Remove(filepath.Join(s.dir, sub, e.Name()))
+			log.Printf("clean %s %s", sub, e.Name())
+		}
+	}
+}
+
+// format_ext returns the file extension of a target format
+func format_ext(format string) string {
+	if format == "jpeg" {
+		return ".jpg"
+	}
+	return "." + format
+}
+
+func new_id() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// isID reports whether id is one new_id returns, so it can be used as a file name
+func isID(id string) bool {
+	if len(id) != 16 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func write_json(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func write_error(w http.ResponseWriter, code int, msg string) {
+	write_json(w, code, map[string]string{"error": msg})
+}
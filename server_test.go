@@ -0,0 +1,183 @@
+package mosaic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// test_server returns a Server with the lib "test" and its http handler, its goroutines stop with the test
+func test_server(t *testing.T, keep time.Duration) (*Server, *httptest.Server) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib")
+	if err := os.Mkdir(lib, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	write_test_lib(t, lib, 24)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req := test_request(lib, filepath.Join(dir, "database.bin"), "Square", 2)
+	s, err := NewServer(ctx, req, map[string]string{"test": lib}, filepath.Join(dir, "server"), 4, keep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// do_json sends body to the server and decodes the json response into v, it returns the status code
+func do_json(t *testing.T, method string, url string, body []byte, v interface{}) int {
+	r, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		json.NewDecoder(resp.Body).Decode(v)
+	}
+	return resp.StatusCode
+}
+
+func upload_test_src(t *testing.T, url string) string {
+	var b bytes.Buffer
+	if err := png.Encode(&b, test_src(16, 12)); err != nil {
+		t.Fatal(err)
+	}
+	var res map[string]string
+	if code := do_json(t, http.MethodPost, url+"/srcs", b.Bytes(), &res); code != http.StatusCreated {
+		t.Fatalf("upload got %d", code)
+	}
+	return res["id"]
+}
+
+func TestServerDeleteSrc(t *testing.T) {
+	s, ts := test_server(t, 0)
+	id := upload_test_src(t, ts.URL)
+
+	var ids []string
+	if do_json(t, http.MethodGet, ts.URL+"/srcs", nil, &ids); fmt.Sprint(ids) != fmt.Sprint([]string{id}) {
+		t.Fatalf("srcs %v", ids)
+	}
+
+	// a job waiting for the src keeps it
+	s.lock.Lock()
+	s.jobs["waiting"] = &Job{ID: "waiting", Request: JobRequest{Src: id}, State: "queued"}
+	s.lock.Unlock()
+	if code := do_json(t, http.MethodDelete, ts.URL+"/srcs/"+id, nil, nil); code != http.StatusConflict {
+		t.Fatalf("delete of a src in use got %d", code)
+	}
+	s.lock.Lock()
+	s.jobs["waiting"].State = "canceled"
+	s.lock.Unlock()
+
+	if code := do_json(t, http.MethodDelete, ts.URL+"/srcs/"+id, nil, nil); code != http.StatusOK {
+		t.Fatalf("delete got %d", code)
+	}
+	for _, path := range []string{"/srcs/" + id, "/srcs/../database.bin", "/srcs/nosuchsrc"} {
+		if code := do_json(t, http.MethodDelete, ts.URL+path, nil, nil); code != http.StatusNotFound {
+			t.Fatalf("delete %s got %d", path, code)
+		}
+	}
+
+	// a job of a deleted src is not queued
+	body, _ := json.Marshal(JobRequest{Src: id, LibName: "test"})
+	if code := do_json(t, http.MethodPost, ts.URL+"/jobs", body, nil); code != http.StatusBadRequest {
+		t.Fatalf("job of a deleted src got %d", code)
+	}
+}
+
+func TestServerClean(t *testing.T) {
+	s, ts := test_server(t, time.Hour)
+	id := upload_test_src(t, ts.URL)
+
+	body, _ := json.Marshal(JobRequest{Src: id, LibName: "test"})
+	var job Job
+	if code := do_json(t, http.MethodPost, ts.URL+"/jobs", body, &job); code != http.StatusAccepted {
+		t.Fatalf("start job got %d", code)
+	}
+	deadline := time.Now().Add(time.Minute)
+	for job.State == "queued" || job.State == "running" {
+		if time.Now().After(deadline) {
+			t.Fatalf("job still %s", job.State)
+		}
+		time.Sleep(10 * time.Millisecond)
+		do_json(t, http.MethodGet, ts.URL+"/jobs/"+job.ID, nil, &job)
+	}
+	if job.State != "done" {
+		t.Fatalf("job %s %s", job.State, job.Error)
+	}
+	// the 16*12 cells of test_request each take a tile from the cache
+	if job.TileHit+job.TileMiss != 16*12 || job.TileMiss == 0 {
+		t.Fatalf("tile cache hit %d miss %d", job.TileHit, job.TileMiss)
+	}
+	target := filepath.Join(s.dir, "targets", job.ID+".png")
+	orphan := filepath.Join(s.dir, "targets", "orphan.png")
+	if err := os.WriteFile(orphan, []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is older than keep yet
+	s.clean(time.Now())
+	for _, filename := range []string{target, orphan, filepath.Join(s.dir, "srcs", id)} {
+		if _, err := os.Stat(filename); err != nil {
+			t.Fatalf("cleaned %s too early", filename)
+		}
+	}
+	if code := do_json(t, http.MethodGet, ts.URL+"/jobs/"+job.ID, nil, nil); code != http.StatusOK {
+		t.Fatalf("job forgotten too early, got %d", code)
+	}
+
+	s.clean(time.Now().Add(2 * time.Hour))
+	if code := do_json(t, http.MethodGet, ts.URL+"/jobs/"+job.ID, nil, nil); code != http.StatusNotFound {
+		t.Fatalf("old job still kept, got %d", code)
+	}
+	for _, sub := range []string{"srcs", "targets"} {
+		entries, _ := os.ReadDir(filepath.Join(s.dir, sub))
+		if len(entries) != 0 {
+			t.Fatalf("old %s still kept: %d", sub, len(entries))
+		}
+	}
+}
+
+func TestServerMaxFinished(t *testing.T) {
+	s, _ := test_server(t, 0)
+	start := time.Now()
+	s.lock.Lock()
+	for i := 0; i < serverMaxFinished+5; i++ {
+		id := fmt.Sprintf("job%04d", i)
+		s.jobs[id] = &Job{ID: id, State: "done", target: filepath.Join(s.dir, "targets", id+".png"), finished: start.Add(time.Duration(i) * time.Second)}
+	}
+	s.jobs["running"] = &Job{ID: "running", State: "running"}
+	s.lock.Unlock()
+
+	// keep 0 keeps jobs of any age, but no more than serverMaxFinished finished ones
+	s.clean(start.Add(1000 * time.Hour))
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.jobs) != serverMaxFinished+1 {
+		t.Fatalf("kept %d jobs", len(s.jobs))
+	}
+	for id := range s.jobs {
+		if id != "running" && strings.Compare(id, "job0005") < 0 {
+			t.Fatalf("kept the old job %s", id)
+		}
+	}
+	if s.jobs["running"] == nil {
+		t.Fatalf("forgot the running job")
+	}
+}
@@ -0,0 +1,283 @@
+package mosaic
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"sort"
+
+	"golang.org/x/image/draw"
+)
+
+type bigtiffEntry struct {
+	tag    uint16
+	typ    uint16
+	values []uint64
+	ascii  string
+}
+
+// encode_bigtiff writes img as an uncompressed RGB BigTIFF, which has 64 bit offsets and so no 4GB limit
+func encode_bigtiff(w io.Writer, img image.Image, description string) error {
+	const (
+		tShort = 3
+		tLong  = 4
+		tASCII = 2
+		tLong8 = 16
+	)
+
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+	rowsize := uint64(width) * 3
+	rowsperstrip := maxInt(int((1<<20)/maxInt(int(rowsize), 1)), 1)
+	strips := (height + rowsperstrip - 1) / rowsperstrip
+
+	// header, then the pixels, then the IFD with its values that do not fit in the entries
+	const header = 16
+	offsets := make([]uint64, strips)
+	counts := make([]uint64, strips)
+	pos := uint64(header)
+	for i := range offsets {
+		rows := minInt(rowsperstrip, height-i*rowsperstrip)
+		offsets[i] = pos
+		counts[i] = uint64(rows) * rowsize
+		pos += counts[i]
+	}
+	ifdoffset := pos + pos%2
+
+	entries := []bigtiffEntry{
+		{tag: 256, typ: tLong, values: []uint64{uint64(width)}},
+		{tag: 257, typ: tLong, values: []uint64{uint64(height)}},
+		{tag: 258, typ: tShort, values: []uint64{8, 8, 8}},
+		{tag: 259, typ: tShort, values: []uint64{1}},
+		{tag: 262, typ: tShort, values: []uint64{2}},
+		{tag: 270, typ: tASCII, ascii: description + "\x00"},
+		{tag: 273, typ: tLong8, values: offsets},
+		{tag: 277, typ: tShort, values: []uint64{3}},
+		{tag: 278, typ: tLong, values: []uint64{uint64(rowsperstrip)}},
+		{tag: 279, typ: tLong8, values: counts},
+		{tag: 284, typ: tShort, values: []uint64{1}},
+	}
+
+	size := func(e bigtiffEntry) uint64 {
+		switch e.typ {
+		case tShort:
+			return uint64(len(e.values)) * 2
+		case tLong:
+			return uint64(len(e.values)) * 4
+		case tASCII:
+			return uint64(len(e.ascii))
+		}
+		return uint64(len(e.values)) * 8
+	}
+
+	// the IFD: count, entries of 20 bytes, next IFD offset
+	extra := ifdoffset + 8 + uint64(len(entries))*20 + 8
+
+	buf := make([]byte, 0, 64)
+	buf = append(buf, 'I', 'I', 43, 0, 8, 0, 0, 0)
+	buf = append_le64(buf, ifdoffset)
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+
+	row := image.NewRGBA(image.Rect(0, 0, width, 1))
+	line := make([]byte, rowsize)
+	for y := 0; y < height; y++ {
+		draw.Draw(row, row.Bounds(), img, image.Point{bounds.Min.X, bounds.Min.Y + y}, draw.Src)
+		for x := 0; x < width; x++ {
+			// RGBA is alpha premultiplied, the target is opaque over black
+			copy(line[x*3:x*3+3], row.Pix[x*4:x*4+3])
+		}
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+	}
+	if pos%2 == 1 {
+		if _, err := w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+
+	buf = buf[:0]
+	buf = append_le64(buf, uint64(len(entries)))
+	var values []byte
+	for _, e := range entries {
+		buf = append_le16(buf, e.tag)
+		buf = append_le16(buf, e.typ)
+		n := uint64(len(e.values))
+		if e.typ == tASCII {
+			n = uint64(len(e.ascii))
+		}
+		buf = append_le64(buf, n)
+
+		var data []byte
+		switch e.typ {
+		case tShort:
+			for _, v := range e.values {
+				data = append_le16(data, uint16(v))
+			}
+		case tLong:
+			for _, v := range e.values {
+				data = append_le32(data, uint32(v))
+			}
+		case tASCII:
+			data = []byte(e.ascii)
+		default:
+			for _, v := range e.values {
+				data = append_le64(data, v)
+			}
+		}
+
+		if size(e) <= 8 {
+			buf = append(buf, data...)
+			buf = append(buf, make([]byte, 8-len(data))...)
+		} else {
+			buf = append_le64(buf, extra+uint64(len(values)))
+			values = append(values, data...)
+			if len(values)%2 == 1 {
+				values = append(values, 0)
+			}
+		}
+	}
+	buf = append_le64(buf, 0)
+
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	_, err := w.Write(values)
+	return err
+}
+
+func append_le16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func append_le32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func append_le64(b []byte, v uint64) []byte {
+	return append_le32(append_le32(b, uint32(v)), uint32(v>>32))
+}
+
+// tiffDescriptionWriter passes a little endian tiff whose IFD comes last, as x/image/tiff writes it, on to w,
+// and holds only the IFD back to add an ImageDescription tag to it on Finish
+type tiffDescriptionWriter struct {
+	w           io.Writer
+	description string
+	pos         int64
+	ifdoffset   int64
+	head        []byte
+	ifd         []byte
+}
+
+func (tw *tiffDescriptionWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(tw.head) < 8 {
+		need := minInt(8-len(tw.head), len(p))
+		tw.head = append(tw.head, p[:need]...)
+		p = p[need:]
+		if len(tw.head) < 8 {
+			return n, nil
+		}
+
+		tw.ifdoffset = int64(binary.LittleEndian.Uint32(tw.head[4:]))
+		if string(tw.head[:4]) != "II*\x00" || tw.ifdoffset < 8 {
+			return 0, errors.New("bad tiff")
+		}
+		if _, err := tw.w.Write(tw.head); err != nil {
+			return 0, err
+		}
+		tw.pos = 8
+	}
+
+	if pass := int(minInt64(int64(len(p)), tw.ifdoffset-tw.pos)); pass > 0 {
+		if _, err := tw.w.Write(p[:pass]); err != nil {
+			return 0, err
+		}
+		tw.pos += int64(pass)
+		p = p[pass:]
+	}
+	tw.ifd = append(tw.ifd, p...)
+	return n, nil
+}
+
+// Finish writes the IFD with the description
+func (tw *tiffDescriptionWriter) Finish() error {
+	if len(tw.head) < 8 || tw.pos < tw.ifdoffset {
+		return errors.New("tiff too short")
+	}
+	ifd, err := tiff_add_description(tw.ifd, uint32(tw.ifdoffset), tw.description)
+	if err != nil {
+		return err
+	}
+	_, err = tw.w.Write(ifd)
+	return err
+}
+
+// tiffTypeSize is the byte size of a value of each tiff field type
+var tiffTypeSize = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// tiff_add_description returns the little endian IFD at ifdoffset, followed by the values it points to, with an
+// ImageDescription entry added, the values move 12 bytes on and the description goes after them
+func tiff_add_description(ifd []byte, ifdoffset uint32, description string) ([]byte, error) {
+	le := binary.LittleEndian
+	if len(ifd) < 2 {
+		return nil, errors.New("bad tiff ifd")
+	}
+	n := int(le.Uint16(ifd))
+	if len(ifd) < 2+n*12+4 {
+		return nil, errors.New("bad tiff ifd")
+	}
+	values := ifd[2+n*12+4:]
+
+	entries := make([][]byte, 0, n+1)
+	for i := 0; i < n; i++ {
+		entry := append([]byte{}, ifd[2+i*12:2+i*12+12]...)
+		if le.Uint16(entry) == 270 {
+			return nil, errors.New("tiff has a description")
+		}
+		size, ok := tiffTypeSize[le.Uint16(entry[2:])]
+		if !ok {
+			return nil, errors.New("bad tiff ifd type")
+		}
+		if uint64(size)*uint64(le.Uint32(entry[4:])) > 4 {
+			le.PutUint32(entry[8:], le.Uint32(entry[8:])+12)
+		}
+		entries = append(entries, entry)
+	}
+
+	text := append([]byte(description), 0)
+	entry := make([]byte, 12)
+	le.PutUint16(entry, 270)
+	le.PutUint16(entry[2:], 2)
+	le.PutUint32(entry[4:], uint32(len(text)))
+	if len(text) <= 4 {
+		copy(entry[8:], text)
+	} else {
+		le.PutUint32(entry[8:], ifdoffset+uint32(2+(n+1)*12+4+len(values)))
+	}
+	entries = append(entries, entry)
+	sort.SliceStable(entries, func(i, j int) bool { return le.Uint16(entries[i]) < le.Uint16(entries[j]) })
+
+	ret := make([]byte, 2, 2+len(entries)*12+4+len(values)+len(text))
+	le.PutUint16(ret, uint16(len(entries)))
+	for _, e := range entries {
+		ret = append(ret, e...)
+	}
+	ret = append(ret, ifd[2+n*12:2+n*12+4]...)
+	ret = append(ret, values...)
+	if len(text) > 4 {
+		ret = append(ret, text...)
+	}
+	return ret, nil
+}
+
+func minInt64(x, y int64) int64 {
+	if x < y {
+		return x
+	}
+	return y
+}
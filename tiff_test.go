@@ -0,0 +1,95 @@
+package mosaic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestEncodeBigtiff(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		width, height int
+		strips        int
+	}{
+		{"one strip", 5, 3, 1},
+		{"strip per row", 400000, 3, 3},
+	} {
+		img := image.NewRGBA(image.Rect(2, 1, 2+tt.width, 1+tt.height))
+		for y := 0; y < tt.height; y++ {
+			for x := 0; x < minInt(tt.width, 16); x++ {
+				img.Set(2+x, 1+y, color.RGBA{uint8(x * 16), uint8(y * 80), uint8(x + y), 255})
+			}
+		}
+		// premultiplied, the target is opaque over black
+		img.Set(2, 1, color.RGBA{50, 40, 30, 128})
+
+		var b bytes.Buffer
+		if err := encode_bigtiff(&b, img, "go-mosaic seed=7"); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		data := b.Bytes()
+		if !bytes.HasPrefix(data, []byte{'I', 'I', 43, 0, 8, 0, 0, 0}) {
+			t.Fatalf("%s: header % x", tt.name, data[:8])
+		}
+
+		fields := read_tiff_ifd(t, data)
+		values := func(tag uint16) []uint64 {
+			f, ok := fields[tag]
+			if !ok {
+				t.Fatalf("%s: no tag %d", tt.name, tag)
+			}
+			var vs []uint64
+			for i := uint64(0); i < f.count; i++ {
+				switch f.typ {
+				case 3:
+					vs = append(vs, uint64(binary.LittleEndian.Uint16(f.data[i*2:])))
+				case 4:
+					vs = append(vs, uint64(binary.LittleEndian.Uint32(f.data[i*4:])))
+				case 16:
+					vs = append(vs, binary.LittleEndian.Uint64(f.data[i*8:]))
+				default:
+					t.Fatalf("%s: tag %d type %d", tt.name, tag, f.typ)
+				}
+			}
+			return vs
+		}
+		single := map[uint16]uint64{256: uint64(tt.width), 257: uint64(tt.height), 259: 1, 262: 2, 277: 3, 284: 1}
+		for tag, want := range single {
+			if vs := values(tag); len(vs) != 1 || vs[0] != want {
+				t.Fatalf("%s: tag %d %v want %d", tt.name, tag, vs, want)
+			}
+		}
+		if vs := values(258); len(vs) != 3 || vs[0] != 8 || vs[1] != 8 || vs[2] != 8 {
+			t.Fatalf("%s: bits per sample %v", tt.name, vs)
+		}
+		if f := fields[270]; f.typ != 2 || string(f.data) != "go-mosaic seed=7\x00" {
+			t.Fatalf("%s: description %q", tt.name, f.data)
+		}
+
+		offsets, counts := values(273), values(279)
+		rowsperstrip := values(278)[0]
+		if len(offsets) != tt.strips || len(counts) != tt.strips {
+			t.Fatalf("%s: strips %d %d want %d", tt.name, len(offsets), len(counts), tt.strips)
+		}
+		var pixels []byte
+		for i := range offsets {
+			rows := minInt(int(rowsperstrip), tt.height-i*int(rowsperstrip))
+			if counts[i] != uint64(rows*tt.width*3) || offsets[i]+counts[i] > uint64(len(data)) {
+				t.Fatalf("%s: strip %d at %d of %d", tt.name, i, offsets[i], counts[i])
+			}
+			pixels = append(pixels, data[offsets[i]:offsets[i]+counts[i]]...)
+		}
+		for y := 0; y < tt.height; y++ {
+			for x := 0; x < tt.width; x++ {
+				c := img.RGBAAt(2+x, 1+y)
+				i := (y*tt.width + x) * 3
+				if pixels[i] != c.R || pixels[i+1] != c.G || pixels[i+2] != c.B {
+					t.Fatalf("%s: pixel %d,%d % x want %v", tt.name, x, y, pixels[i:i+3], c)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+
+	"golang.org/x/image/draw"
+)
+
+// Transform is a flip or rotation a tile may be placed with, Quads[i] is the quadrant of the tile that ends up at quadrant i
+type Transform struct {
+	Name  string
+	Quads [4]int
+}
+
+var (
+	TransformNone   = Transform{"None", [4]int{0, 1, 2, 3}}
+	TransformFlipH  = Transform{"FlipH", [4]int{1, 0, 3, 2}}
+	TransformFlipV  = Transform{"FlipV", [4]int{2, 3, 0, 1}}
+	TransformRot90  = Transform{"Rot90", [4]int{2, 0, 3, 1}}
+	TransformRot180 = Transform{"Rot180", [4]int{3, 2, 1, 0}}
+	TransformRot270 = Transform{"Rot270", [4]int{1, 3, 0, 2}}
+)
+
+func isTransform(transform string) bool {
+	return transform == "None" || transform == "Flip" || transform == "All"
+}
+
+// get_transforms returns the transforms tried for every tile, Flip only mirrors left to right as tiles always were,
+// upside down tiles are only tried with All, quarter turns only fit square tiles
+func get_transforms(transform string, square bool) []Transform {
+	switch transform {
+	case "Flip":
+		return []Transform{TransformNone, TransformFlipH}
+	case "All":
+		if square {
+			return []Transform{TransformNone, TransformFlipH, TransformFlipV, TransformRot90, TransformRot180, TransformRot270}
+		}
+		return []Transform{TransformNone, TransformFlipH, TransformFlipV, TransformRot180}
+	}
+	return []Transform{TransformNone}
+}
+
+// get_transform returns the transform named name, as in Transform.Name
+func get_transform(name string) (Transform, bool) {
+	for _, t := range []Transform{TransformNone, TransformFlipH, TransformFlipV, TransformRot90, TransformRot180, TransformRot270} {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return TransformNone, false
+}
+
+// Grid returns the 2*2 grid of a tile with grid once placed with t
+func (t Transform) Grid(grid [4]color.RGBA) [4]color.RGBA {
+	var ret [4]color.RGBA
+	for i, q := range t.Quads {
+		ret[i] = grid[q]
+	}
+	return ret
+}
+
+// Apply returns img placed with t
+func (t Transform) Apply(img image.Image) image.Image {
+	if t.Name == TransformNone.Name {
+		return img
+	}
+
+	src, ok := img.(*image.RGBA)
+	if !ok {
+		src = image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+		draw.Copy(src, image.Point{}, img, img.Bounds(), draw.Src, nil)
+	}
+
+	bounds := src.Bounds()
+	w := bounds.Dx()
+	h := bounds.Dy()
+	dstw, dsth := w, h
+	if t.Name == TransformRot90.Name || t.Name == TransformRot270.Name {
+		dstw, dsth = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstw, dsth))
+
+	for y := 0; y < dsth; y++ {
+		for x := 0; x < dstw; x++ {
+			sx, sy := x, y
+			switch t.Name {
+			case TransformFlipH.Name:
+				sx = w - 1 - x
+			case TransformFlipV.Name:
+				sy = h - 1 - y
+			case TransformRot180.Name:
+				sx, sy = w-1-x, h-1-y
+			case TransformRot90.Name:
+				sx, sy = y, h-1-x
+			case TransformRot270.Name:
+				sx, sy = w-1-y, x
+			}
+			s := src.PixOffset(bounds.Min.X+sx, bounds.Min.Y+sy)
+			d := dst.PixOffset(x, y)
+			copy(dst.Pix[d:d+4], src.Pix[s:s+4])
+		}
+	}
+	return dst
+}
+
+// pick_tile returns the candidate and transform whose grid is closest to the grid of cell, ties are broken with rnd
+func pick_tile(candidates []FileInfo, cell Cell, transforms []Transform, rnd *rand.Rand) (FileInfo, Transform, float64) {
+	var best FileInfo
+	besttransform := TransformNone
+	bestdiff := math.MaxFloat64
+	ties := 0
+
+	for _, fi := range candidates {
+		grid := tile_grid(fi)
+		for _, t := range transforms {
+			diff := grid_distance(t.Grid(grid), cell.Grid)
+			if diff < bestdiff-1e-9 {
+				best, besttransform, bestdiff = fi, t, diff
+				ties = 1
+			} else if diff <= bestdiff+1e-9 {
+				ties++
+				if rnd.Intn(ties) == 0 {
+					best, besttransform = fi, t
+				}
+			}
+		}
+	}
+
+	return best, besttransform, bestdiff
+}
+
+// tile_grid returns the grid of fi, its avg color when it was indexed before grids were saved
+func tile_grid(fi FileInfo) [4]color.RGBA {
+	if fi.Grid == ([4]color.RGBA{}) {
+		avg := color.RGBA{fi.R, fi.G, fi.B, 0}
+		return [4]color.RGBA{avg, avg, avg, avg}
+	}
+	return fi.Grid
+}
+
+// cell_rand returns the random source of cell, it only depends on seed and the place of the cell,
+// so the target does not change with the worker num or the order the cells are done in
+func cell_rand(seed int64, cell Cell) *rand.Rand {
+	h := uint64(seed)
+	for _, v := range []int{cell.X, cell.Y, cell.Size} {
+		// splitmix64
+		h += uint64(int64(v)) + 0x9e3779b97f4a7c15
+		h = (h ^ (h >> 30)) * 0xbf58476d1ce4e5b9
+		h = (h ^ (h >> 27)) * 0x94d049bb133111eb
+		h ^= h >> 31
+	}
+	return rand.New(rand.NewSource(int64(h)))
+}
+
+func grid_distance(g1 [4]color.RGBA, g2 [4]color.RGBA) float64 {
+	var diff float64
+	for i := range g1 {
+		diff += ColorDistance(g1[i], g2[i])
+	}
+	return diff / 4
+}
@@ -0,0 +1,35 @@
+package mosaic
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestGetTransforms(t *testing.T) {
+	for _, tt := range []struct {
+		transform string
+		square    bool
+		want      string
+	}{
+		{"None", true, "None"},
+		// the default mirrors left to right only, tiles are never upside down unless asked for
+		{"Flip", true, "None FlipH"},
+		{"Flip", false, "None FlipH"},
+		{"All", true, "None FlipH FlipV Rot90 Rot180 Rot270"},
+		{"All", false, "None FlipH FlipV Rot180"},
+	} {
+		var names []string
+		for _, tr := range get_transforms(tt.transform, tt.square) {
+			names = append(names, tr.Name)
+		}
+		if got := fmt.Sprint(names); got != "["+tt.want+"]" {
+			t.Errorf("%s square %v: %s", tt.transform, tt.square, got)
+		}
+	}
+
+	req := &Request{}
+	set_defaults(req)
+	if *req.Transform != "Flip" {
+		t.Fatalf("default transform %s", *req.Transform)
+	}
+}
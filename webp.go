@@ -0,0 +1,354 @@
+package mosaic
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/xml"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+)
+
+// webp can not be wider or higher than this
+const webpMaxSize = 16384
+
+// bitWriter writes bits least significant first, as VP8L reads them
+type bitWriter struct {
+	buf   bytes.Buffer
+	bits  uint64
+	nbits uint
+}
+
+func (bw *bitWriter) write(v uint32, n uint) {
+	bw.bits |= uint64(v) << bw.nbits
+	bw.nbits += n
+	for bw.nbits >= 8 {
+		bw.buf.WriteByte(byte(bw.bits))
+		bw.bits >>= 8
+		bw.nbits -= 8
+	}
+}
+
+func (bw *bitWriter) flush() []byte {
+	if bw.nbits > 0 {
+		bw.buf.WriteByte(byte(bw.bits))
+		bw.bits, bw.nbits = 0, 0
+	}
+	return bw.buf.Bytes()
+}
+
+// prefixCode is a canonical huffman code, codes are bit reversed so they can be written least significant first
+type prefixCode struct {
+	lengths []int
+	codes   []uint32
+	single  bool // one symbol, which takes no bits
+}
+
+func (pc *prefixCode) write(bw *bitWriter, symbol int) {
+	if pc.single {
+		return
+	}
+	bw.write(pc.codes[symbol], uint(pc.lengths[symbol]))
+}
+
+// new_prefix_code builds the code of the histogram with no code longer than limit
+func new_prefix_code(histogram []int, limit int) *prefixCode {
+	pc := &prefixCode{lengths: make([]int, len(histogram)), codes: make([]uint32, len(histogram))}
+
+	used := 0
+	last := 0
+	for i, n := range histogram {
+		if n > 0 {
+			used++
+			last = i
+		}
+	}
+	if used <= 1 {
+		pc.lengths[last] = 1
+		pc.single = true
+		return pc
+	}
+
+	counts := append([]int(nil), histogram...)
+	for {
+		huffman_lengths(counts, pc.lengths)
+		longest := 0
+		for _, l := range pc.lengths {
+			longest = maxInt(longest, l)
+		}
+		if longest <= limit {
+			break
+		}
+		// flatten the histogram until the tree is shallow enough
+		for i, n := range counts {
+			if n > 0 {
+				counts[i] = (n + 1) / 2
+			}
+		}
+	}
+
+	// canonical codes, shorter codes first, then by symbol
+	var blcount [16]uint32
+	for _, l := range pc.lengths {
+		if l > 0 {
+			blcount[l]++
+		}
+	}
+	var next [16]uint32
+	code := uint32(0)
+	for l := 1; l < 16; l++ {
+		code = (code + blcount[l-1]) << 1
+		next[l] = code
+	}
+	for i, l := range pc.lengths {
+		if l == 0 {
+			continue
+		}
+		c := next[l]
+		next[l]++
+		var rev uint32
+		for j := 0; j < l; j++ {
+			rev = rev<<1 | (c>>uint(j))&1
+		}
+		pc.codes[i] = rev
+	}
+	return pc
+}
+
+type huffmanNode struct {
+	count  int
+	symbol int // -1 for inner nodes
+	left   *huffmanNode
+	right  *huffmanNode
+}
+
+type huffmanHeap []*huffmanNode
+
+func (h huffmanHeap) Len() int { return len(h) }
+func (h huffmanHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].symbol < h[j].symbol
+}
+func (h huffmanHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *huffmanHeap) Push(x interface{}) { *h = append(*h, x.(*huffmanNode)) }
+func (h *huffmanHeap) Pop() interface{} {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// huffman_lengths sets the huffman code length of every symbol with a count, at least two symbols have one
+func huffman_lengths(counts []int, lengths []int) {
+	h := &huffmanHeap{}
+	for i, n := range counts {
+		lengths[i] = 0
+		if n > 0 {
+			*h = append(*h, &huffmanNode{count: n, symbol: i})
+		}
+	}
+	heap.Init(h)
+	for h.Len() > 1 {
+		a := heap.Pop(h).(*huffmanNode)
+		b := heap.Pop(h).(*huffmanNode)
+		heap.Push(h, &huffmanNode{count: a.count + b.count, symbol: -1, left: a, right: b})
+	}
+
+	var walk func(n *huffmanNode, depth int)
+	walk = func(n *huffmanNode, depth int) {
+		if n.symbol >= 0 {
+			lengths[n.symbol] = depth
+			return
+		}
+		walk(n.left, depth+1)
+		walk(n.right, depth+1)
+	}
+	walk((*h)[0], 0)
+}
+
+// codeLengthCodeOrder is the order the code length code lengths are written in
+var codeLengthCodeOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// write_prefix_code writes the code of an alphabet, as a simple code when it has at most two symbols below 256
+func write_prefix_code(bw *bitWriter, pc *prefixCode) {
+	var symbols []int
+	for i, l := range pc.lengths {
+		if l > 0 {
+			symbols = append(symbols, i)
+		}
+	}
+
+	if len(symbols) <= 2 && symbols[len(symbols)-1] < 256 {
+		bw.write(1, 1)
+		bw.write(uint32(len(symbols)-1), 1)
+		if symbols[0] < 2 {
+			bw.write(0, 1)
+			bw.write(uint32(symbols[0]), 1)
+		} else {
+			bw.write(1, 1)
+			bw.write(uint32(symbols[0]), 8)
+		}
+		if len(symbols) == 2 {
+			bw.write(uint32(symbols[1]), 8)
+		}
+		return
+	}
+
+	// the lengths are written literally with a code of their own
+	histogram := make([]int, 19)
+	for _, l := range pc.lengths {
+		histogram[l]++
+	}
+	lc := new_prefix_code(histogram, 7)
+
+	n := 4
+	for i, s := range codeLengthCodeOrder {
+		if lc.lengths[s] > 0 {
+			n = maxInt(n, i+1)
+		}
+	}
+	bw.write(0, 1)
+	bw.write(uint32(n-4), 4)
+	for _, s := range codeLengthCodeOrder[:n] {
+		bw.write(uint32(lc.lengths[s]), 3)
+	}
+
+	// no max symbol, every length is written
+	bw.write(0, 1)
+	for _, l := range pc.lengths {
+		lc.write(bw, l)
+	}
+}
+
+// encode_webp writes img as a lossless webp (VP8L) with the subtract green transform and no backward references,
+// a comment goes in an XMP chunk of an extended webp, only for opaque pics, since x/image/webp rejects
+// the VP8X alpha flag with a VP8L chunk
+func encode_webp(w io.Writer, img image.Image, comment string) error {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+	if width < 1 || height < 1 || width > webpMaxSize || height > webpMaxSize {
+		return errors.New("webp size error")
+	}
+
+	argb := make([][4]uint8, 0, width*height)
+	alpha := false
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			// green, red and blue minus green, blue minus green, alpha
+			argb = append(argb, [4]uint8{c.G, c.R - c.G, c.B - c.G, c.A})
+			if c.A != 255 {
+				alpha = true
+			}
+		}
+	}
+
+	histograms := [5][]int{make([]int, 256+24), make([]int, 256), make([]int, 256), make([]int, 256), make([]int, 40)}
+	for _, p := range argb {
+		for i := 0; i < 4; i++ {
+			histograms[i][p[i]]++
+		}
+	}
+	histograms[4][0] = 1
+
+	bw := &bitWriter{}
+	bw.write(0x2f, 8)
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	if alpha {
+		bw.write(1, 1)
+	} else {
+		bw.write(0, 1)
+	}
+	bw.write(0, 3)
+
+	// subtract green transform, then no more transforms
+	bw.write(1, 1)
+	bw.write(2, 2)
+	bw.write(0, 1)
+
+	// no color cache, no meta prefix codes
+	bw.write(0, 1)
+	bw.write(0, 1)
+
+	codes := make([]*prefixCode, 5)
+	for i, histogram := range histograms {
+		codes[i] = new_prefix_code(histogram, 15)
+		write_prefix_code(bw, codes[i])
+	}
+
+	for _, p := range argb {
+		for i := 0; i < 4; i++ {
+			codes[i].write(bw, int(p[i]))
+		}
+	}
+	data := bw.flush()
+
+	var xmp []byte
+	if comment != "" && !alpha {
+		xmp = webp_xmp(comment)
+	}
+
+	size := len(data)
+	padded := size + size%2
+	riffsize := 4 + 8 + padded
+	if xmp != nil {
+		riffsize += 8 + 10 + 8 + len(xmp) + len(xmp)%2
+	}
+
+	var header []byte
+	header = append(header, "RIFF"...)
+	header = append_le32(header, uint32(riffsize))
+	header = append(header, "WEBP"...)
+	if xmp != nil {
+		// VP8X with only the XMP flag, then the canvas size minus one in 24 bits each
+		header = append(header, "VP8X"...)
+		header = append_le32(header, 10)
+		header = append(header, webpXMPFlag, 0, 0, 0)
+		header = append(header, byte(width-1), byte((width-1)>>8), byte((width-1)>>16))
+		header = append(header, byte(height-1), byte((height-1)>>8), byte((height-1)>>16))
+	}
+	header = append(header, "VP8L"...)
+	header = append_le32(header, uint32(size))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if padded != size {
+		if _, err := w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	if xmp == nil {
+		return nil
+	}
+
+	chunk := append_le32([]byte("XMP "), uint32(len(xmp)))
+	chunk = append(chunk, xmp...)
+	if len(xmp)%2 != 0 {
+		chunk = append(chunk, 0)
+	}
+	_, err := w.Write(chunk)
+	return err
+}
+
+// webpXMPFlag is the VP8X flag of a webp with an XMP chunk
+const webpXMPFlag = 1 << 2
+
+// webp_xmp returns an XMP packet with comment as its dc:description
+func webp_xmp(comment string) []byte {
+	var b bytes.Buffer
+	b.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>" +
+		`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		`<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:description><rdf:Alt>` +
+		`<rdf:li xml:lang="x-default">`)
+	xml.EscapeText(&b, []byte(comment))
+	b.WriteString(`</rdf:li></rdf:Alt></dc:description></rdf:Description></rdf:RDF></x:xmpmeta><?xpacket end="w"?>`)
+	return b.Bytes()
+}
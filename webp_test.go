@@ -0,0 +1,189 @@
+package mosaic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func TestEncodeWebpRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := func(w, h int, alpha bool) image.Image {
+		img := image.NewNRGBA(image.Rect(0, 0, w, h))
+		rnd.Read(img.Pix)
+		if !alpha {
+			for i := 3; i < len(img.Pix); i += 4 {
+				img.Pix[i] = 255
+			}
+		}
+		return img
+	}
+	flat := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for i := range flat.Pix {
+		flat.Pix[i] = []uint8{10, 200, 30, 255}[i%4]
+	}
+	twocolor := image.NewRGBA(image.Rect(0, 0, 9, 4))
+	for i := range twocolor.Pix {
+		if i/4%3 == 0 {
+			twocolor.Pix[i] = 255
+		}
+	}
+
+	for _, tt := range []struct {
+		name string
+		img  image.Image
+	}{
+		{"1x1", random(1, 1, false)},
+		{"1x1 alpha", random(1, 1, true)},
+		{"3x5", random(3, 5, false)},
+		{"3x5 alpha", random(3, 5, true)},
+		{"flat", flat},
+		{"two colors", twocolor},
+		{"gradient", test_src(300, 200)},
+		{"noise", random(257, 129, true)},
+		{"offset bounds", flat.SubImage(image.Rect(5, 7, 20, 9))},
+	} {
+		var b bytes.Buffer
+		if err := encode_webp(&b, tt.img, ""); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if b.Len()%2 != 0 {
+			t.Fatalf("%s: odd riff size %d", tt.name, b.Len())
+		}
+		dec, err := webp.Decode(bytes.NewReader(b.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: decode %s", tt.name, err)
+		}
+
+		bounds := tt.img.Bounds()
+		if dec.Bounds().Size() != bounds.Size() {
+			t.Fatalf("%s: size %v", tt.name, dec.Bounds().Size())
+		}
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				want := color.NRGBAModel.Convert(tt.img.At(bounds.Min.X+x, bounds.Min.Y+y))
+				got := color.NRGBAModel.Convert(dec.At(x, y))
+				if got != want {
+					t.Fatalf("%s: pixel %d,%d %v want %v", tt.name, x, y, got, want)
+				}
+			}
+		}
+	}
+
+	for _, size := range []image.Point{{0, 1}, {webpMaxSize + 1, 1}} {
+		if err := encode_webp(&bytes.Buffer{}, image.NewRGBA(image.Rectangle{Max: size}), ""); err == nil {
+			t.Fatalf("encode_webp of %v did not fail", size)
+		}
+	}
+}
+
+func TestNewPrefixCodeLimit(t *testing.T) {
+	// fibonacci counts make the plain huffman code as deep as there are symbols
+	histogram := make([]int, 40)
+	histogram[0], histogram[1] = 1, 1
+	for i := 2; i < len(histogram); i++ {
+		histogram[i] = histogram[i-1] + histogram[i-2]
+	}
+
+	pc := new_prefix_code(histogram, 15)
+	kraft := 0.0
+	for i, l := range pc.lengths {
+		if l < 1 || l > 15 {
+			t.Fatalf("symbol %d length %d", i, l)
+		}
+		kraft += 1 / float64(int(1)<<l)
+	}
+	if kraft != 1 {
+		t.Fatalf("code is not complete, kraft sum %v", kraft)
+	}
+
+	// a prefix free code, no code is the start of a longer one
+	for i := range pc.codes {
+		for j := range pc.codes {
+			if i != j && pc.lengths[i] <= pc.lengths[j] && pc.codes[j]&(1<<pc.lengths[i]-1) == pc.codes[i] {
+				t.Fatalf("code of %d is a prefix of the code of %d", i, j)
+			}
+		}
+	}
+}
+
+func TestEncodeWebpXMP(t *testing.T) {
+	opaque := test_src(7, 5)
+	transparent := image.NewNRGBA(image.Rect(0, 0, 7, 5))
+
+	for _, tt := range []struct {
+		name    string
+		img     image.Image
+		comment string
+		chunks  string
+	}{
+		{"plain", opaque, "", "VP8L"},
+		{"seed", opaque, "go-mosaic seed=42", "VP8X VP8L XMP "},
+		{"escaped", opaque, "a<b & \"c\"", "VP8X VP8L XMP "},
+		// x/image/webp can not read a VP8X with the alpha flag before a VP8L
+		{"alpha", transparent, "go-mosaic seed=42", "VP8L"},
+	} {
+		var b bytes.Buffer
+		if err := encode_webp(&b, tt.img, tt.comment); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		data := b.Bytes()
+		if string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" || int(binary.LittleEndian.Uint32(data[4:])) != len(data)-8 {
+			t.Fatalf("%s: bad riff header", tt.name)
+		}
+
+		var ids []string
+		chunks := map[string][]byte{}
+		for p := 12; p < len(data); {
+			if p+8 > len(data) {
+				t.Fatalf("%s: chunk header past end", tt.name)
+			}
+			id, size := string(data[p:p+4]), int(binary.LittleEndian.Uint32(data[p+4:]))
+			if p+8+size > len(data) {
+				t.Fatalf("%s: chunk %s past end", tt.name, id)
+			}
+			ids = append(ids, id)
+			chunks[id] = data[p+8 : p+8+size]
+			p += 8 + size + size%2
+		}
+		if got := strings.Join(ids, " "); got != tt.chunks {
+			t.Fatalf("%s: chunks %q want %q", tt.name, got, tt.chunks)
+		}
+
+		if vp8x, ok := chunks["VP8X"]; ok {
+			w := int(vp8x[4]) | int(vp8x[5])<<8 | int(vp8x[6])<<16
+			h := int(vp8x[7]) | int(vp8x[8])<<8 | int(vp8x[9])<<16
+			if len(vp8x) != 10 || vp8x[0] != webpXMPFlag || w != 6 || h != 4 {
+				t.Fatalf("%s: VP8X %v", tt.name, vp8x)
+			}
+			var desc struct {
+				Text string `xml:"RDF>Description>description>Alt>li"`
+			}
+			if err := xml.Unmarshal(chunks["XMP "], &desc); err != nil || desc.Text != tt.comment {
+				t.Fatalf("%s: xmp %q %v", tt.name, desc.Text, err)
+			}
+		}
+
+		dec, err := webp.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: decode %s", tt.name, err)
+		}
+		var want, got bytes.Buffer
+		png.Encode(&want, tt.img)
+		png.Encode(&got, dec)
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Fatalf("%s: decoded pixels differ", tt.name)
+		}
+		if c, err := webp.DecodeConfig(bytes.NewReader(data)); err != nil || c.Width != 7 || c.Height != 5 {
+			t.Fatalf("%s: config %+v %v", tt.name, c, err)
+		}
+	}
+}